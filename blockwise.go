@@ -13,21 +13,26 @@ type BlockMetadata struct {
 }
 
 func (s *Server) expireBlocks() {
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
 	for {
-		var toDel []string
-		s.blockCache.Range(func(key, value interface{}) bool {
-			bce, ok := value.(*blockCacheEntry)
-			if ok && time.Now().After(bce.expires) {
-				toDel = append(toDel, key.(string))
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			var toDel []string
+			s.blockCache.Range(func(key, value interface{}) bool {
+				bce, ok := value.(*blockCacheEntry)
+				if ok && now.After(bce.expires) {
+					toDel = append(toDel, key.(string))
+				}
+				return true
+			})
+			for _, key := range toDel {
+				s.blockCache.Delete(key)
 			}
-			return true
-		})
-		for _, key := range toDel {
-			s.blockCache.Delete(key)
 		}
-		time.Sleep(time.Second * 2)
 	}
-
 }
 
 func blockDecode(i interface{}) (*BlockMetadata, error) {
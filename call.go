@@ -0,0 +1,335 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Call is an exchange started with SendAsync.
+type Call struct {
+	Request *Message
+	// Response and Error are set once Done is closed.
+	Response *Message
+	Error    error
+	// Done is closed when the exchange completed.
+	Done chan struct{}
+
+	server  *Server
+	addr    string
+	options *SendOptions
+	t       Transport
+	data    []byte
+
+	mux      sync.Mutex
+	timer    *time.Timer
+	start    time.Time
+	timeout  time.Duration
+	maxWait  time.Duration
+	retries  int
+	nstart   bool
+	cancel   context.CancelFunc
+	finished bool
+	// gen is advanced whenever timer is replaced or stopped, a timer that
+	// already fired finds it changed and does nothing
+	gen int
+	// the request before it was sent, for a retry with Echo
+	payload []byte
+	opts    []option
+}
+
+// SendAsync starts sending msg to addr and returns without waiting for the
+// response. Retransmissions and the response are handled by timers and the
+// receiving transport, so many exchanges can be in flight without a goroutine
+// each; blockwise transfers, requests to OSCORE peers and exchanges queued
+// behind NSTART fall back to running Send in a goroutine.
+func (s *Server) SendAsync(addr string, msg *Message, options *SendOptions) *Call {
+	if options == nil {
+		options = s.NewOptions()
+	}
+	c := &Call{Request: msg, Done: make(chan struct{}), server: s, addr: addr, options: options}
+	if !s.beginExchange() {
+		c.finished = true
+		c.Error = ErrServerClosed
+		close(c.Done)
+		return c
+	}
+	s.calls.Store(c, struct{}{})
+
+	msg.withNoResponse(options)
+	c.payload, c.opts = msg.Payload, make([]option, len(msg.opts))
+	copy(c.opts, msg.opts)
+	msg.Meta.RemoteAddr = addr
+	msg.Meta.BlockSize = options.BlockSize
+	msg.Meta.MaxMessageSize = options.MaxMessageSize
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if msg.IsRequest() && msg.Code != CodeEmpty && msg.Option(OptOscore) == nil && s.oscorePeer(addr) != nil {
+		// requests to OSCORE peers are protected by Send
+		c.sendGo()
+		return c
+	}
+
+	if conn := s.findStreamConn(addr); conn != nil {
+		if msg.RequiresBlockwise() {
+			c.sendGo()
+			return c
+		}
+		msg.Meta.ListenerName = conn.listener.name
+		msg.Meta.Reliable = true
+		c.maxWait = options.ActTimeout
+		if options.MaxRetransmit > 0 {
+			c.maxWait = time.Duration(float64(float64(options.ActTimeout*time.Duration(math.Pow(2.0, float64(options.MaxRetransmit+1))-1)) * options.RandomFactor))
+		}
+		expectReply := msg.IsRequest() && msg.Code != CodeEmpty && options.NoResponse == 0
+		if expectReply {
+			s.pendingSaveFunc(msg, c.answer)
+		}
+		if err := conn.write(msg); err != nil {
+			c.finish(nil, err)
+		} else if !expectReply {
+			c.finish(nil, nil)
+		} else {
+			c.start = time.Now()
+			c.schedule(c.maxWait, c.expire)
+		}
+		return c
+	}
+
+	if msg.RequiresBlockwise() || (msg.IsConfirmable() && !s.nstartTryInc(addr, options.NStart)) {
+		c.sendGo()
+		return c
+	}
+	c.nstart = msg.IsConfirmable()
+
+	t, err := s.transportFor(addr, options)
+	if err != nil {
+		c.finish(nil, err)
+		return c
+	}
+	c.t = t
+	msg.Meta.ListenerName = t.Name()
+	if d, ok := t.(*DtlsListener); ok {
+		msg.Meta.DtlsPeer = d.FindPeer(addr)
+	}
+
+	if msg.IsConfirmable() {
+		s.pendingSaveFunc(msg, c.answer)
+	} else if msg.MessageID == 0 {
+		msg.MessageID = s.GetNextMsgId()
+	}
+
+	c.data, err = s.marshalDatagram(msg)
+	if err == nil {
+		err = t.WriteTo(addr, c.data)
+	}
+	if err != nil {
+		c.finish(nil, err)
+		return c
+	}
+	if !msg.IsConfirmable() || msg.Type == TypeAcknowledgement {
+		c.finish(nil, nil)
+		return c
+	}
+
+	c.start = time.Now()
+	c.maxWait = time.Duration(float64(float64(options.ActTimeout*time.Duration(math.Pow(2.0, float64(options.MaxRetransmit+1))-1)) * options.RandomFactor))
+	c.timeout = time.Duration(((float64(options.ActTimeout)*options.RandomFactor)-float64(options.ActTimeout))*rand.Float64()) + options.ActTimeout
+	logDebug(msg, nil, "sent async message (maxWait:%0.2fs timeout:%0.2fs maxRetransmit:%d)", c.maxWait.Seconds(), c.timeout.Seconds(), options.MaxRetransmit)
+	if options.MaxRetransmit == -1 {
+		c.schedule(c.maxWait, c.expire)
+	} else {
+		c.schedule(c.timeout, c.retransmit)
+	}
+	return c
+}
+
+// Wait waits for the exchange to complete and returns its response, unless
+// ctx is done first. The exchange goes on after ctx is done, see Cancel.
+func (c *Call) Wait(ctx context.Context) (*Message, error) {
+	select {
+	case <-c.Done:
+		return c.Response, c.Error
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel stops the exchange, it completes with context.Canceled unless it
+// had completed already.
+func (c *Call) Cancel() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.finished {
+		c.finish(nil, context.Canceled)
+	}
+}
+
+// sendGo runs the exchange with Send in a goroutine.
+func (c *Call) sendGo() {
+	c.runGo(c.server.SendContext)
+}
+
+// runGo runs the exchange with send in a goroutine.
+func (c *Call) runGo(send func(ctx context.Context, addr string, msg *Message, options *SendOptions) (*Message, error)) {
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		rsp, err := send(ctx, c.addr, c.Request, c.options)
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if !c.finished {
+			c.finish(rsp, err)
+		}
+	}()
+}
+
+// schedule runs f with c.mux held after d, unless the exchange finished or
+// the timer was replaced or stopped before, c.mux is held.
+func (c *Call) schedule(d time.Duration, f func()) {
+	c.stopTimer()
+	gen := c.gen
+	c.timer = time.AfterFunc(d, func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		if !c.finished && c.gen == gen {
+			f()
+		}
+	})
+}
+
+// stopTimer stops the timer, also if it already fired, c.mux is held.
+func (c *Call) stopTimer() {
+	c.gen++
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// answer is called by handleAcknowledgement with the answer to the request.
+func (c *Call) answer(rsp *Message) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.finished {
+		c.answerLocked(rsp)
+	}
+}
+
+// answerLocked handles the answer to the request, c.mux is held.
+func (c *Call) answerLocked(rsp *Message) {
+	if rsp.Type == TypeReset {
+		c.finish(nil, ErrReset)
+		return
+	}
+	if echo := echoChallenge(c.Request, rsp); echo != nil {
+		c.resendEcho(echo)
+		return
+	}
+	if rsp.Code == CodeEmpty && c.Request.IsRequest() && c.options.NoResponse != 0 {
+		c.finish(nil, nil)
+		return
+	}
+	if rsp.Code == CodeEmpty && c.Request.IsRequest() {
+		// the response follows separately, the request is no longer
+		// retransmitted (RFC 7252 section 5.2.2)
+		c.schedule(c.maxWait-time.Since(c.start), c.expire)
+		return
+	}
+	if block2 := rsp.GetBlock2(); block2 != nil && block2.More {
+		c.stopTimer()
+		var ctx context.Context
+		ctx, c.cancel = context.WithCancel(context.Background())
+		go func() {
+			rsp, err := c.server.sendBlock2(ctx, c.addr, c.Request, rsp, c.options)
+			c.mux.Lock()
+			defer c.mux.Unlock()
+			if !c.finished {
+				c.finish(rsp, err)
+			}
+		}()
+		return
+	}
+	c.finish(rsp, nil)
+}
+
+// resendEcho sends the request once more with the Echo value of a 4.01
+// challenge (RFC 9175 section 2.4), c.mux is held.
+func (c *Call) resendEcho(echo []byte) {
+	logDebug(c.Request, nil, "echo challenge received, resending async request")
+	c.stopTimer()
+	c.server.pendingDelete(c.Request)
+	if c.nstart {
+		// Send takes its own NSTART slot
+		c.server.nstartDec(c.addr)
+		c.nstart = false
+	}
+	c.Request.Payload, c.Request.opts = c.payload, c.opts
+	c.Request.WithOption(OptEcho, echo, true)
+	c.Request.MessageID = 0
+	c.runGo(c.server.sendContext)
+}
+
+// retransmit resends the request, c.mux is held.
+func (c *Call) retransmit() {
+	if c.retries >= c.options.MaxRetransmit {
+		logDebug(c.Request, nil, "send async ack timeout (%d transmits)", c.retries+1)
+		c.finish(nil, ErrTimeout)
+		return
+	}
+	c.retries++
+	if err := c.t.WriteTo(c.addr, c.data); err != nil {
+		c.finish(nil, err)
+		return
+	}
+	c.timeout *= 2
+	if c.retries == c.options.MaxRetransmit {
+		c.timeout = c.maxWait - time.Since(c.start)
+	}
+	logDebug(c.Request, nil, "resent async message (timeout:%0.2fs)", c.timeout.Seconds())
+	c.schedule(c.timeout, c.retransmit)
+}
+
+// expire ends the exchange without an answer, c.mux is held.
+func (c *Call) expire() {
+	c.finish(nil, ErrTimeout)
+}
+
+// finish completes the exchange, c.mux is held.
+func (c *Call) finish(rsp *Message, err error) {
+	c.finished = true
+	c.server.pendingDelete(c.Request)
+	c.Response = rsp
+	c.Error = err
+	c.stopTimer()
+	if c.nstart {
+		c.server.nstartDec(c.addr)
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.server.calls.Delete(c)
+	c.server.endExchange()
+	close(c.Done)
+}
+
+// abortCalls ends the exchanges started with SendAsync when the Server is
+// closed.
+func (s *Server) abortCalls() {
+	s.calls.Range(func(key, value interface{}) bool {
+		c := key.(*Call)
+		c.mux.Lock()
+		if !c.finished {
+			c.finish(nil, ErrServerClosed)
+		}
+		c.mux.Unlock()
+		return true
+	})
+}
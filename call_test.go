@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestCallRetransmitAfterAck lets the retransmission timer fire while the
+// empty ack of the request is handled, the request must not be sent again.
+func TestCallRetransmitAfterAck(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	client := newTestServer(t, nil)
+
+	options := client.NewOptions().WithRetry(4, time.Millisecond*30, 1.0)
+	c := client.SendAsync(peer.LocalAddr().String(), newTestRequest(TypeConfirmable, CodeGet, "slow"), options)
+	buf := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := peer.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := parseMessage(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mux.Lock()
+	time.Sleep(time.Millisecond * 80)
+	c.answerLocked(&Message{Type: TypeAcknowledgement, Code: CodeEmpty, MessageID: req.MessageID})
+	c.mux.Unlock()
+
+	_ = peer.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	if n, err := peer.Read(buf); err == nil {
+		m, _ := parseMessage(buf[:n])
+		t.Fatalf("request %d sent again after its ack", m.MessageID)
+	}
+
+	// the separate response completes the exchange
+	rsp := &Message{Type: TypeConfirmable, Code: RspCodeContent, MessageID: 0x1234, Token: req.Token, Payload: []byte("late")}
+	data, _ := rsp.marshalBinary()
+	if _, err := peer.WriteToUDP(data, from); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	got, err := c.Wait(ctx)
+	if err != nil || got == nil || string(got.Payload) != "late" {
+		t.Fatal(got, err)
+	}
+}
@@ -0,0 +1,161 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errCborMalformed = errors.New("coap: malformed cbor")
+
+// CBOR major types (RFC 8949 section 3.1), only what the security layers
+// need is supported.
+const (
+	cborMajorUint  = 0
+	cborMajorNint  = 1
+	cborMajorBytes = 2
+	cborMajorText  = 3
+	cborMajorArray = 4
+	cborMajorMap   = 5
+	cborTrue       = 0xf5
+	cborNull       = 0xf6
+)
+
+func cborHead(buf []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(buf, major<<5|byte(n))
+	case n < 1<<8:
+		return append(buf, major<<5|24, byte(n))
+	case n < 1<<16:
+		buf = append(buf, major<<5|25)
+		return binary.BigEndian.AppendUint16(buf, uint16(n))
+	case n < 1<<32:
+		buf = append(buf, major<<5|26)
+		return binary.BigEndian.AppendUint32(buf, uint32(n))
+	default:
+		buf = append(buf, major<<5|27)
+		return binary.BigEndian.AppendUint64(buf, n)
+	}
+}
+
+func cborInt(buf []byte, n int64) []byte {
+	if n < 0 {
+		return cborHead(buf, cborMajorNint, uint64(-1-n))
+	}
+	return cborHead(buf, cborMajorUint, uint64(n))
+}
+
+func cborBytes(buf []byte, b []byte) []byte {
+	return append(cborHead(buf, cborMajorBytes, uint64(len(b))), b...)
+}
+
+// cborBytesOrNull encodes b as a byte string, or null when b is nil.
+func cborBytesOrNull(buf []byte, b []byte) []byte {
+	if b == nil {
+		return append(buf, cborNull)
+	}
+	return cborBytes(buf, b)
+}
+
+func cborText(buf []byte, s string) []byte {
+	return append(cborHead(buf, cborMajorText, uint64(len(s))), s...)
+}
+
+func cborArray(buf []byte, n int) []byte {
+	return cborHead(buf, cborMajorArray, uint64(n))
+}
+
+func cborMap(buf []byte, n int) []byte {
+	return cborHead(buf, cborMajorMap, uint64(n))
+}
+
+// cborReader decodes the items of a CBOR sequence in order.
+type cborReader struct {
+	b []byte
+}
+
+func (r *cborReader) empty() bool {
+	return len(r.b) == 0
+}
+
+// peek returns the major type of the next item.
+func (r *cborReader) peek() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, errCborMalformed
+	}
+	return r.b[0] >> 5, nil
+}
+
+func (r *cborReader) head() (byte, uint64, error) {
+	if len(r.b) == 0 {
+		return 0, 0, errCborMalformed
+	}
+	major, info := r.b[0]>>5, r.b[0]&0x1f
+	var n uint64
+	var size int
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, errCborMalformed
+	}
+	if len(r.b) < 1+size {
+		return 0, 0, errCborMalformed
+	}
+	for _, b := range r.b[1 : 1+size] {
+		n = n<<8 | uint64(b)
+	}
+	r.b = r.b[1+size:]
+	return major, n, nil
+}
+
+func (r *cborReader) int() (int64, error) {
+	major, n, err := r.head()
+	if err != nil {
+		return 0, err
+	}
+	if n > 1<<63-1 {
+		return 0, errCborMalformed
+	}
+	switch major {
+	case cborMajorUint:
+		return int64(n), nil
+	case cborMajorNint:
+		return -1 - int64(n), nil
+	}
+	return 0, errCborMalformed
+}
+
+func (r *cborReader) string(major byte) ([]byte, error) {
+	m, n, err := r.head()
+	if err != nil {
+		return nil, err
+	}
+	if m != major || n > uint64(len(r.b)) {
+		return nil, errCborMalformed
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+func (r *cborReader) bytes() ([]byte, error) {
+	return r.string(cborMajorBytes)
+}
+
+func (r *cborReader) text() (string, error) {
+	b, err := r.string(cborMajorText)
+	return string(b), err
+}
@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestCborRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 23, 24, 255, 256, 65535, 65536, 1 << 32, math.MaxInt64, -1, -24, -25, -256, -257, math.MinInt64} {
+		r := &cborReader{b: cborInt(nil, n)}
+		if got, err := r.int(); err != nil || got != n || !r.empty() {
+			t.Errorf("int %d decoded as %d, %v", n, got, err)
+		}
+	}
+	for _, n := range []int{0, 23, 24, 300} {
+		b := bytes.Repeat([]byte{0xab}, n)
+		r := &cborReader{b: cborText(cborBytes(nil, b), string(b))}
+		if got, err := r.bytes(); err != nil || !bytes.Equal(got, b) {
+			t.Errorf("%d bytes decoded as %x, %v", n, got, err)
+		}
+		if got, err := r.text(); err != nil || got != string(b) || !r.empty() {
+			t.Errorf("%d byte text decoded as %q, %v", n, got, err)
+		}
+	}
+}
+
+func TestCborMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		read func(r *cborReader) error
+	}{
+		{"empty int", "", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"empty bytes", "", func(r *cborReader) error { _, err := r.bytes(); return err }},
+		{"empty peek", "", func(r *cborReader) error { _, err := r.peek(); return err }},
+		{"reserved info", "1c", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"indefinite length", "5f4101ff", func(r *cborReader) error { _, err := r.bytes(); return err }},
+		{"truncated uint8", "18", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"truncated uint16", "1901", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"truncated uint64", "1b00000000", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"int overflow", "1bffffffffffffffff", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"nint overflow", "3b8000000000000000", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"int of bytes", "4101", func(r *cborReader) error { _, err := r.int(); return err }},
+		{"bytes of int", "01", func(r *cborReader) error { _, err := r.bytes(); return err }},
+		{"text of bytes", "4161", func(r *cborReader) error { _, err := r.text(); return err }},
+		{"truncated bytes", "430102", func(r *cborReader) error { _, err := r.bytes(); return err }},
+		{"huge bytes", "5bffffffffffffffff01", func(r *cborReader) error { _, err := r.bytes(); return err }},
+		{"id of text", "6161", func(r *cborReader) error { _, err := edhocReadID(r); return err }},
+		{"id of long int", "1818", func(r *cborReader) error { _, err := edhocReadID(r); return err }},
+		{"id cred of large map", "a2044132", func(r *cborReader) error { _, err := edhocReadIDCred(r); return err }},
+		{"id cred of other label", "a1054132", func(r *cborReader) error { _, err := edhocReadIDCred(r); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.read(&cborReader{b: mustHex(t, tt.data)}); err != errCborMalformed {
+				t.Fatalf("expected %v, got %v", errCborMalformed, err)
+			}
+		})
+	}
+}
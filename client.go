@@ -0,0 +1,217 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/qwerty-iot/dtls/v2"
+)
+
+// Client exchanges messages with a single endpoint from an ephemeral local
+// socket, without a Server listening on a known port.
+type Client struct {
+	server  *Server
+	network string
+	addr    string
+	options *SendOptions
+}
+
+type dialConfig struct {
+	config       *Config
+	options      *SendOptions
+	dtlsIdentity []byte
+	tlsConfig    *tls.Config
+	timeout      time.Duration
+}
+
+// DialOption configures a Client created by Dial.
+type DialOption func(dc *dialConfig)
+
+// WithDialConfig sets the configuration of the Server underlying the Client.
+func WithDialConfig(config *Config) DialOption {
+	return func(dc *dialConfig) {
+		dc.config = config
+	}
+}
+
+// WithDialSendOptions sets the SendOptions the Client uses by default.
+func WithDialSendOptions(options *SendOptions) DialOption {
+	return func(dc *dialConfig) {
+		dc.options = options
+	}
+}
+
+// WithDtlsIdentity sets the PSK identity of a dtls Client, the key is looked
+// up in the dtls keystores.
+func WithDtlsIdentity(identity []byte) DialOption {
+	return func(dc *dialConfig) {
+		dc.dtlsIdentity = identity
+	}
+}
+
+// WithTlsConfig sets the configuration of a tls Client.
+func WithTlsConfig(config *tls.Config) DialOption {
+	return func(dc *dialConfig) {
+		dc.tlsConfig = config
+	}
+}
+
+// WithDialTimeout limits the time spent on the DTLS handshake.
+func WithDialTimeout(timeout time.Duration) DialOption {
+	return func(dc *dialConfig) {
+		dc.timeout = timeout
+	}
+}
+
+// Dial returns a Client for the endpoint at addr over network, which is one
+// of "udp", "dtls", "tcp" or "tls".
+func Dial(network string, addr string, opts ...DialOption) (*Client, error) {
+	dc := &dialConfig{timeout: time.Second * 20}
+	for _, opt := range opts {
+		opt(dc)
+	}
+
+	var server *Server
+	var err error
+	c := &Client{network: network}
+
+	switch network {
+	case "udp":
+		uaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if server, err = NewServer(dc.config, ":0", nil); err != nil {
+			return nil, err
+		}
+		c.addr = uaddr.String()
+	case "dtls":
+		listener, err := dtls.NewUdpListener(":0", time.Second*5)
+		if err != nil {
+			return nil, err
+		}
+		listener.AddCipherSuite(dtls.CipherSuite_TLS_PSK_WITH_AES_128_CCM_8)
+		listener.AddCipherSuite(dtls.CipherSuite_TLS_PSK_WITH_AES_128_GCM_SHA256)
+		listener.AddCipherSuite(dtls.CipherSuite_TLS_PSK_WITH_AES_128_CBC_SHA256)
+		listener.AddCompressionMethod(dtls.CompressionMethod_Null)
+		if server, err = NewServer(dc.config, "", listener); err != nil {
+			_ = listener.Shutdown()
+			return nil, err
+		}
+		peer, err := listener.AddPeerWithParams(&dtls.PeerParams{Addr: addr, Identity: dc.dtlsIdentity, HandshakeTimeout: dc.timeout})
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+		// client peers start out queueing their records, the server reads
+		// them from the listener instead
+		peer.UseQueue(false)
+		c.addr = peer.RemoteAddr()
+	case "tcp", "tls":
+		if server, err = NewServer(dc.config, "", nil); err != nil {
+			return nil, err
+		}
+		if network == "tcp" {
+			c.addr, err = server.DialTcp(addr)
+		} else {
+			c.addr, err = server.DialTls(addr, dc.tlsConfig)
+		}
+		if err != nil {
+			server.Close()
+			return nil, err
+		}
+	default:
+		return nil, errors.New("coap: unsupported network: " + network)
+	}
+
+	c.server = server
+	c.options = dc.options
+	if c.options == nil {
+		c.options = server.NewOptions()
+	}
+	return c, nil
+}
+
+// Addr returns the address of the endpoint, as seen in Metadata.RemoteAddr
+// of the messages it sends.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Options returns a copy of the default SendOptions of the Client.
+func (c *Client) Options() *SendOptions {
+	so := *c.options
+	return &so
+}
+
+// Send sends msg to the endpoint and returns its response, see Server.Send.
+func (c *Client) Send(msg *Message, options *SendOptions) (*Message, error) {
+	return c.SendContext(context.Background(), msg, options)
+}
+
+// SendContext is Send that gives up when ctx is done.
+func (c *Client) SendContext(ctx context.Context, msg *Message, options *SendOptions) (*Message, error) {
+	if options == nil {
+		options = c.Options()
+	}
+	return c.server.SendContext(ctx, c.addr, msg, options)
+}
+
+// SendAsync starts sending msg to the endpoint, see Server.SendAsync.
+func (c *Client) SendAsync(msg *Message, options *SendOptions) *Call {
+	if options == nil {
+		options = c.Options()
+	}
+	return c.server.SendAsync(c.addr, msg, options)
+}
+
+// Observe registers with the resource at path of the endpoint, see
+// Server.Observe.
+func (c *Client) Observe(ctx context.Context, path string, callback ObserveCallback, arg interface{}) (string, error) {
+	return c.server.ObserveContext(ctx, c.addr, CodeGet, path, nil, None, callback, arg, c.Options())
+}
+
+// ObserveCancel deregisters the observation with token of the resource at path.
+func (c *Client) ObserveCancel(ctx context.Context, path string, token string) error {
+	return c.server.ObserveCancelContext(ctx, c.addr, path, token, c.Options())
+}
+
+// Edhoc runs EDHOC with the endpoint, the OSCORE context it establishes
+// protects the requests sent by the Client from then on.
+func (c *Client) Edhoc(ctx context.Context, config *EdhocConfig) (*OscoreContext, error) {
+	return c.server.EdhocInitiate(ctx, c.addr, config, c.Options())
+}
+
+// Ping checks that the endpoint is alive, with an empty confirmable message
+// answered by a reset on udp and dtls or a 7.02 Ping on tcp and tls.
+func (c *Client) Ping(ctx context.Context) error {
+	if c.network == "tcp" || c.network == "tls" {
+		timeout := c.options.ActTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		return c.server.Ping(c.addr, timeout)
+	}
+	_, err := c.SendContext(ctx, &Message{Type: TypeConfirmable, Code: CodeEmpty}, nil)
+	if errors.Is(err, ErrReset) {
+		return nil
+	}
+	if err == nil {
+		return errors.New("coap: ping answered without reset")
+	}
+	return err
+}
+
+// Close releases the socket of the Client, exchanges in flight fail with
+// ErrServerClosed.
+func (c *Client) Close() error {
+	c.server.Close()
+	return nil
+}
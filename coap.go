@@ -5,8 +5,10 @@
 package coap
 
 import (
+	"context"
 	"crypto/rand"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -19,11 +21,19 @@ type Server struct {
 	config       *Config
 	udpListener  *UdpListener
 	dtlsListener *DtlsListener
+	tcpListener  *TcpListener
+	tlsListener  *TcpListener
+	wsListener   *TcpListener
+	streamMux    sync.Mutex
+
+	transports   []Transport
+	transportMux sync.RWMutex
 
 	dedupMap         sync.Map
 	dedupDeleteAfter sync.Map
 
-	routes map[string]*routeEntry
+	routes     map[string]*routeEntry
+	middleware []Middleware
 
 	pendingMap    map[string]*pendingEntry
 	pendingMidMap map[uint16]*pendingEntry
@@ -32,33 +42,80 @@ type Server struct {
 
 	blockCache sync.Map
 
+	observers    sync.Map
+	observations sync.Map
+
+	calls sync.Map
+
+	oscorePeers      map[string]*OscoreContext
+	oscoreRecipients map[oscoreKey]*OscoreContext
+	oscoreMux        sync.RWMutex
+
+	// echoKey authenticates the Echo values issued by the Server
+	echoKey []byte
+
+	nstartMap map[string]*nstart
+	nstartMux sync.Mutex
+
 	lastActivity time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	drainMux  sync.RWMutex
+	draining  bool
+	inflight  sync.WaitGroup
+	handlers  int64
+	exchanges int64
+	stopped   chan struct{}
 }
 
 type Config struct {
 	DeduplicateExpiration   time.Duration
 	DeduplicateInterval     time.Duration
 	ObserveNotFoundCallback ObserveNotFoundCallback
-	BlockDefaultSize        int
-	BlockInactivityTimeout  time.Duration
-	MaxMessageDefaultSize   int
-	NStart                  int
-	Name                    string
-	Ref                     any
-	ProxyCallbacks          map[string]ProxyFunction
+	// ObserveConfirmableInterval is the longest time between confirmable
+	// notifications to an observer that registered non-confirmable.
+	ObserveConfirmableInterval time.Duration
+	BlockDefaultSize           int
+	BlockInactivityTimeout     time.Duration
+	MaxMessageDefaultSize      int
+	MaxStreamMessageSize       int
+	NStart                     int
+	Name                       string
+	Ref                        any
+	ProxyCallbacks             map[string]ProxyFunction
+	WebsocketCheckOrigin       func(r *http.Request) bool
+	// ShutdownCancelObservers makes Shutdown end the observations of the
+	// Server with a 5.03 notification.
+	ShutdownCancelObservers bool
+	// MulticastLeisure is the period over which responses to multicast
+	// requests are spread (RFC 7252 section 8.2).
+	MulticastLeisure time.Duration
+	// MaxTokenLength enables tokens longer than 8 bytes (RFC 8974) up to
+	// ExtendedMaxTokenLength, it is advertised in the CSM of stream
+	// connections.
+	MaxTokenLength int
 }
 
 func NewConfig() *Config {
 	return &Config{
-		DeduplicateExpiration:  time.Second * 600,
-		DeduplicateInterval:    time.Second * 20,
-		BlockDefaultSize:       1024,
-		BlockInactivityTimeout: time.Second * 120,
-		NStart:                 1,
-		MaxMessageDefaultSize:  0,
+		DeduplicateExpiration:      time.Second * 600,
+		DeduplicateInterval:        time.Second * 20,
+		ObserveConfirmableInterval: time.Hour * 24,
+		BlockDefaultSize:           1024,
+		BlockInactivityTimeout:     time.Second * 120,
+		NStart:                     1,
+		MaxMessageDefaultSize:      0,
+		MaxStreamMessageSize:       tcpDefaultMaxMessageSize,
+		MulticastLeisure:           time.Second * 5,
+		MaxTokenLength:             DefaultMaxTokenLength,
 	}
 }
 
+// AddProxyReceiver makes f deliver the messages sent to addresses of the form
+// "prefix:to". The prefix names the transport, NewServer fails if another
+// transport such as "udp" or "dtls" has that name.
 func (c *Config) AddProxyReceiver(prefix string, f ProxyFunction) {
 	if c.ProxyCallbacks == nil {
 		c.ProxyCallbacks = map[string]ProxyFunction{}
@@ -68,22 +125,33 @@ func (c *Config) AddProxyReceiver(prefix string, f ProxyFunction) {
 
 func NewServer(conf *Config, udpAddr string, dtlsListener *dtls.Listener) (*Server, error) {
 	h := &Server{}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
 	h.config = NewConfig()
 	h.routes = map[string]*routeEntry{}
+	h.AddMethodRoute(CodeGet, WellKnownCorePath, h.wellKnownCore)
 	h.pendingMap = map[string]*pendingEntry{}
 	h.pendingMidMap = map[uint16]*pendingEntry{}
+	h.nstartMap = map[string]*nstart{}
+	h.oscorePeers = map[string]*OscoreContext{}
+	h.oscoreRecipients = map[oscoreKey]*OscoreContext{}
+	h.echoKey = make([]byte, 32)
+	rand.Read(h.echoKey)
 	h.pendingMsgId = uint16(time.Now().UnixNano() % 32767)
 
 	if len(udpAddr) != 0 {
-		h.udpListener = &UdpListener{}
-		if err := h.udpListener.listen("udp", udpAddr, h); err != nil {
+		udpListener, err := NewUdpListener("udp", udpAddr)
+		if err != nil {
+			return nil, err
+		}
+		h.udpListener = udpListener
+		if err := h.AddTransport(h.udpListener); err != nil {
 			return nil, err
 		}
 	}
 
 	if dtlsListener != nil {
-		h.dtlsListener = &DtlsListener{}
-		if err := h.dtlsListener.listen("dtls", dtlsListener, h); err != nil {
+		h.dtlsListener = NewDtlsListener("dtls", dtlsListener)
+		if err := h.AddTransport(h.dtlsListener); err != nil {
 			return nil, err
 		}
 	}
@@ -98,6 +166,9 @@ func NewServer(conf *Config, udpAddr string, dtlsListener *dtls.Listener) (*Serv
 		if conf.ObserveNotFoundCallback != nil {
 			h.config.ObserveNotFoundCallback = conf.ObserveNotFoundCallback
 		}
+		if conf.ObserveConfirmableInterval > 0 {
+			h.config.ObserveConfirmableInterval = conf.ObserveConfirmableInterval
+		}
 		if conf.BlockDefaultSize > 0 {
 			h.config.BlockDefaultSize = conf.BlockDefaultSize
 		}
@@ -107,17 +178,62 @@ func NewServer(conf *Config, udpAddr string, dtlsListener *dtls.Listener) (*Serv
 		if conf.NStart > 0 {
 			h.config.NStart = conf.NStart
 		}
+		if conf.MaxStreamMessageSize > 0 {
+			h.config.MaxStreamMessageSize = conf.MaxStreamMessageSize
+		}
+		if conf.MulticastLeisure > 0 {
+			h.config.MulticastLeisure = conf.MulticastLeisure
+		}
+		if conf.MaxTokenLength > ExtendedMaxTokenLength {
+			h.config.MaxTokenLength = ExtendedMaxTokenLength
+		} else if conf.MaxTokenLength > 0 {
+			h.config.MaxTokenLength = conf.MaxTokenLength
+		}
 		h.config.Ref = conf.Ref
 		h.config.Name = conf.Name
 
 		h.config.ProxyCallbacks = conf.ProxyCallbacks
+		h.config.WebsocketCheckOrigin = conf.WebsocketCheckOrigin
+		h.config.ShutdownCancelObservers = conf.ShutdownCancelObservers
+	}
+
+	for prefix, f := range h.config.ProxyCallbacks {
+		// a prefix must not shadow another transport, such as "udp"
+		if err := h.AddTransport(&proxyTransport{server: h, prefix: prefix, callback: f}); err != nil {
+			h.close()
+			return nil, err
+		}
 	}
 
-	go h.dedupWatcher()
-	go h.expireBlocks()
+	h.stopped = make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.dedupWatcher()
+		}()
+		go func() {
+			defer wg.Done()
+			h.expireBlocks()
+		}()
+		wg.Wait()
+		close(h.stopped)
+	}()
+	servers.Store(h, struct{}{})
 	return h, nil
 }
 
+// servers holds the open servers for the deprecated package level functions.
+var servers sync.Map
+
+func eachServer(f func(s *Server)) {
+	servers.Range(func(key, value interface{}) bool {
+		f(key.(*Server))
+		return true
+	})
+}
+
 func (s *Server) GetRef() any {
 	if s.config != nil {
 		return s.config.Ref
@@ -144,13 +260,10 @@ func (s *Server) GetPorts() (int, int) {
 	return up, dp
 }
 
+// Close stops the Server immediately, see Shutdown to let exchanges in
+// flight finish first.
 func (s *Server) Close() {
-	if s.udpListener != nil {
-		s.udpListener.Close()
-	}
-	if s.dtlsListener != nil {
-		s.dtlsListener.Close()
-	}
+	s.close()
 }
 
 func (s *Server) LastActivity() time.Time {
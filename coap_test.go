@@ -0,0 +1,35 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import "testing"
+
+// newTestServer returns a Server on a loopback udp port, closed when the test
+// ends.
+func newTestServer(t *testing.T, conf *Config) *Server {
+	t.Helper()
+	s, err := NewServer(conf, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestRequest(typ COAPType, code COAPCode, path string) *Message {
+	req := NewMessage()
+	req.Type = typ
+	req.Code = code
+	req.WithPathString(path)
+	return req
+}
+
+// pendingCount returns the number of exchanges waiting for an answer by token
+// and by message id.
+func (s *Server) pendingCount() (int, int) {
+	s.pendingMux.Lock()
+	defer s.pendingMux.Unlock()
+	return len(s.pendingMap), len(s.pendingMidMap)
+}
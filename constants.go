@@ -87,6 +87,15 @@ const (
 	RspCodeProxyingNotSupported    COAPCode = 165
 )
 
+// Signaling Codes (RFC 8323 section 5), only valid on stream transports.
+const (
+	SignalCodeCSM     COAPCode = 225
+	SignalCodePing    COAPCode = 226
+	SignalCodePong    COAPCode = 227
+	SignalCodeRelease COAPCode = 228
+	SignalCodeAbort   COAPCode = 229
+)
+
 var codeNames = [256]string{
 	CodeEmpty:                      "EMPTY",
 	CodeGet:                        "GET",
@@ -119,6 +128,11 @@ var codeNames = [256]string{
 	RspCodeServiceUnavailable:      "ServiceUnavailable",
 	RspCodeGatewayTimeout:          "GatewayTimeout",
 	RspCodeProxyingNotSupported:    "ProxyingNotSupported",
+	SignalCodeCSM:                  "CSM",
+	SignalCodePing:                 "Ping",
+	SignalCodePong:                 "Pong",
+	SignalCodeRelease:              "Release",
+	SignalCodeAbort:                "Abort",
 }
 
 func init() {
@@ -141,6 +155,11 @@ func (c COAPCode) String() string {
 	return codeNames[c]
 }
 
+// IsSignaling returns true for the 7.xx signaling codes of RFC 8323.
+func (c COAPCode) IsSignaling() bool {
+	return c>>5 == 7
+}
+
 func (c COAPCode) NumberString() string {
 	lower := c & 0x1F
 	upper := c >> 5
@@ -160,6 +179,8 @@ const (
 	AppExi        MediaType = 47    // application/exi
 	AppJSON       MediaType = 50    // application/json
 	AppCBOR       MediaType = 60    // application/cbor
+	AppEdhocCBOR  MediaType = 64    // application/edhoc+cbor-seq
+	AppCidEdhoc   MediaType = 65    // application/cid-edhoc+cbor-seq
 	AppSenmlCBOR  MediaType = 112   // application/senml_cbor
 	AppLwm2mTLV   MediaType = 11542 //application/vnd.oma.lwm2m+tlv
 	AppLwm2mJSON  MediaType = 11543 //application/vnd.oma.lwm2m+json
@@ -183,6 +204,10 @@ func (m MediaType) String() string {
 		return "application/json"
 	case AppCBOR:
 		return "application/cbor"
+	case AppEdhocCBOR:
+		return "application/edhoc+cbor-seq"
+	case AppCidEdhoc:
+		return "application/cid-edhoc+cbor-seq"
 	case AppSenmlCBOR:
 		return "application/senml_cbor"
 	case AppLwm2mTLV:
@@ -14,8 +14,12 @@ type dedupEndpoint struct {
 }
 
 type dedupEntry struct {
+	mux     sync.Mutex
 	pending bool
 	rsp     *Message
+	// set by dedupUpdate, the response replaces the one returned by the
+	// handler, which may only be saved later
+	updated bool
 }
 
 func (s *Server) deduplicate(msg *Message) (*dedupEntry, bool) {
@@ -39,21 +43,57 @@ func (s *Server) deduplicate(msg *Message) (*dedupEntry, bool) {
 }
 
 func (entry *dedupEntry) save(rsp *Message) {
+	entry.mux.Lock()
+	if !entry.updated {
+		entry.rsp = rsp
+		entry.pending = false
+	}
+	entry.mux.Unlock()
+}
+
+func (entry *dedupEntry) update(rsp *Message) {
+	entry.mux.Lock()
 	entry.rsp = rsp
 	entry.pending = false
+	entry.updated = true
+	entry.mux.Unlock()
+}
+
+// get returns the cached response, or pending if the request is still being
+// handled.
+func (entry *dedupEntry) get() (rsp *Message, pending bool) {
+	entry.mux.Lock()
+	defer entry.mux.Unlock()
+	return entry.rsp, entry.pending
+}
+
+// dedupUpdate replaces the response cached for msg.
+func (s *Server) dedupUpdate(msg *Message, rsp *Message) {
+	epI, ok := s.dedupMap.Load(msg.Meta.RemoteAddr)
+	if !ok {
+		return
+	}
+	if entryI, found := epI.(*dedupEndpoint).entries.Load(msg.MessageID); found {
+		entryI.(*dedupEntry).update(rsp)
+	}
 }
 
 func (s *Server) dedupWatcher() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Second)
-		now := time.Now()
-		s.dedupDeleteAfter.Range(func(key, value interface{}) bool {
-			expirationTime := value.(time.Time)
-			if expirationTime.Before(now) {
-				s.dedupMap.Delete(key)
-				s.dedupDeleteAfter.Delete(key)
-			}
-			return true
-		})
+		select {
+		case <-s.ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.dedupDeleteAfter.Range(func(key, value interface{}) bool {
+				expirationTime := value.(time.Time)
+				if expirationTime.Before(now) {
+					s.dedupMap.Delete(key)
+					s.dedupDeleteAfter.Delete(key)
+				}
+				return true
+			})
+		}
 	}
 }
@@ -0,0 +1,75 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// echoLength is the length of the Echo values issued by the Server, a
+// timestamp followed by a truncated MAC over it and the client address.
+const echoLength = 16
+
+// echoValue returns the Echo value for the client at addr issued at t.
+func (s *Server) echoValue(addr string, t time.Time) []byte {
+	v := binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+	mac := hmac.New(sha256.New, s.echoKey)
+	mac.Write(v)
+	mac.Write([]byte(addr))
+	return mac.Sum(v)[:echoLength]
+}
+
+// echoFresh returns true if req carries an Echo value the Server issued to
+// its sender no longer than maxAge ago.
+func (s *Server) echoFresh(req *Message, maxAge time.Duration) bool {
+	v, _ := req.Option(OptEcho).([]byte)
+	if len(v) != echoLength {
+		return false
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(v)))
+	if age := time.Since(issued); age < 0 || age > maxAge {
+		return false
+	}
+	return hmac.Equal(v, s.echoValue(req.Meta.RemoteAddr, issued))
+}
+
+// WithFreshness makes the route answer requests that carry no Echo value
+// issued within maxAge with a 4.01 Unauthorized and a new Echo value, so
+// delayed and replayed requests are not acted upon (RFC 9175 section 2.4).
+// Clients using Send repeat the request with the Echo value.
+func WithFreshness(maxAge time.Duration) RouteOption {
+	return func(route *routeEntry) {
+		route.middleware = append([]Middleware{freshness(maxAge)}, route.middleware...)
+	}
+}
+
+func freshness(maxAge time.Duration) Middleware {
+	return func(next RouteCallback) RouteCallback {
+		return func(req *Message) *Message {
+			s := req.Meta.Server
+			if s == nil || s.echoFresh(req, maxAge) {
+				return next(req)
+			}
+			logDebug(req, nil, "request not fresh, sending echo challenge")
+			rsp := req.MakeReply(RspCodeUnauthorized, nil)
+			rsp.WithOption(OptEcho, s.echoValue(req.Meta.RemoteAddr, time.Now()), true)
+			rsp.WithOption(OptMaxAge, 0, true)
+			return rsp
+		}
+	}
+}
+
+// echoChallenge returns the Echo value of a 4.01 response to req, nil if rsp
+// is no such challenge.
+func echoChallenge(req *Message, rsp *Message) []byte {
+	if rsp == nil || !req.IsRequest() || rsp.Code != RspCodeUnauthorized {
+		return nil
+	}
+	echo, _ := rsp.Option(OptEcho).([]byte)
+	return echo
+}
@@ -0,0 +1,214 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEchoFresh(t *testing.T) {
+	s := newTestServer(t, nil)
+	other := newTestServer(t, nil)
+	addr := "192.0.2.1:5683"
+	now := time.Now()
+
+	tamper := s.echoValue(addr, now)
+	tamper[echoLength-1] ^= 1
+
+	tests := []struct {
+		name string
+		echo []byte
+		want bool
+	}{
+		{"fresh", s.echoValue(addr, now), true},
+		{"aged", s.echoValue(addr, now.Add(-time.Second*30)), true},
+		{"expired", s.echoValue(addr, now.Add(-time.Minute*2)), false},
+		{"future", s.echoValue(addr, now.Add(time.Hour)), false},
+		{"other address", s.echoValue("192.0.2.2:5683", now), false},
+		{"other port", s.echoValue("192.0.2.1:5684", now), false},
+		{"other server", other.echoValue(addr, now), false},
+		{"tampered", tamper, false},
+		{"short", s.echoValue(addr, now)[:echoLength-1], false},
+		{"empty", []byte{}, false},
+		{"missing", nil, false},
+	}
+	for _, tt := range tests {
+		req := newTestRequest(TypeConfirmable, CodePost, "x")
+		req.Meta.RemoteAddr = addr
+		if tt.echo != nil {
+			req.WithOption(OptEcho, tt.echo, true)
+		}
+		if got := s.echoFresh(req, time.Minute); got != tt.want {
+			t.Errorf("%s: fresh %t", tt.name, got)
+		}
+	}
+}
+
+// TestEchoChallenge checks Send and SendAsync repeat a request challenged by
+// WithFreshness with the Echo value, the route only sees the fresh request.
+func TestEchoChallenge(t *testing.T) {
+	srv := newTestServer(t, nil)
+	var calls atomic.Int32
+	srv.AddRoute("fresh", func(req *Message) *Message {
+		calls.Add(1)
+		if req.Option(OptEcho) == nil {
+			t.Error("route called without echo")
+		}
+		return req.MakeReply(RspCodeChanged, req.Payload)
+	}, WithFreshness(time.Minute))
+	client := newTestServer(t, nil)
+	addr := srv.udpListener.LocalAddr()
+
+	req := newTestRequest(TypeConfirmable, CodePost, "fresh").WithPayload([]byte("sync"))
+	rsp, err := client.Send(addr, req, nil)
+	if err != nil || rsp == nil || rsp.Code != RspCodeChanged || string(rsp.Payload) != "sync" || calls.Load() != 1 {
+		t.Fatalf("answered %v %v after %d calls", rsp, err, calls.Load())
+	}
+
+	calls.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	req = newTestRequest(TypeConfirmable, CodePost, "fresh").WithPayload([]byte("async"))
+	rsp, err = client.SendAsync(addr, req, nil).Wait(ctx)
+	if err != nil || rsp == nil || rsp.Code != RspCodeChanged || string(rsp.Payload) != "async" || calls.Load() != 1 {
+		t.Fatalf("async answered %v %v after %d calls", rsp, err, calls.Load())
+	}
+}
+
+// TestEchoChallengeRaw checks the challenge itself, and that an Echo value is
+// only accepted from the address it was issued to.
+func TestEchoChallengeRaw(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.AddRoute("fresh", func(req *Message) *Message {
+		return req.MakeReply(RspCodeChanged, nil)
+	}, WithFreshness(time.Minute))
+	port, _ := srv.GetPorts()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+
+	exchange := func(peer *net.UDPConn, mid uint16, echo []byte) *Message {
+		t.Helper()
+		req := newTestRequest(TypeConfirmable, CodePost, "fresh")
+		req.MessageID = mid
+		req.Token = []byte{1, 2}
+		if echo != nil {
+			req.WithOption(OptEcho, echo, true)
+		}
+		data, _ := req.marshalBinary()
+		if _, err := peer.WriteToUDP(data, to); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := parseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &rsp
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	thief, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer thief.Close()
+
+	rsp := exchange(peer, 1, nil)
+	echo, _ := rsp.Option(OptEcho).([]byte)
+	if rsp.Code != RspCodeUnauthorized || len(echo) != echoLength || rsp.Option(OptMaxAge) == nil {
+		t.Fatalf("challenge %s with echo %x", rsp.Code.NumberString(), echo)
+	}
+	echo = append([]byte(nil), echo...)
+
+	if rsp := exchange(thief, 2, echo); rsp.Code != RspCodeUnauthorized {
+		t.Errorf("echo accepted from another address: %s", rsp.Code.NumberString())
+	}
+	if rsp := exchange(peer, 3, echo); rsp.Code != RspCodeChanged {
+		t.Errorf("echo rejected: %s", rsp.Code.NumberString())
+	}
+	expired := srv.echoValue(peer.LocalAddr().String(), time.Now().Add(-time.Minute*2))
+	if rsp := exchange(peer, 4, expired); rsp.Code != RspCodeUnauthorized {
+		t.Errorf("expired echo accepted: %s", rsp.Code.NumberString())
+	}
+}
+
+// TestRequestTagBlock1 interleaves the blocks of two uploads to the same path,
+// their Request-Tag keeps them apart (RFC 9175 section 3.3).
+func TestRequestTagBlock1(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.AddRoute("upload", func(req *Message) *Message {
+		// the response is smaller than a block, it reports the byte the
+		// upload consists of
+		if len(req.Payload) != 150 || bytes.Count(req.Payload, req.Payload[:1]) != 150 {
+			return req.MakeReply(RspCodeBadRequest, nil)
+		}
+		return req.MakeReply(RspCodeChanged, req.Payload[:1])
+	})
+	port, _ := srv.GetPorts()
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	uploads := []struct {
+		tag     []byte
+		payload []byte
+	}{
+		{[]byte{0xa}, bytes.Repeat([]byte("a"), 150)},
+		{[]byte{0xb}, bytes.Repeat([]byte("b"), 150)},
+	}
+	mid := uint16(0x200)
+	buf := make([]byte, 1500)
+	for num := 0; num < 3; num++ {
+		for i, u := range uploads {
+			mid++
+			more := num < 2
+			end := (num + 1) * 64
+			if !more {
+				end = len(u.payload)
+			}
+			req := newTestRequest(TypeConfirmable, CodePost, "upload").WithPayload(u.payload[num*64 : end])
+			req.MessageID = mid
+			req.Token = []byte{byte(i), byte(num)}
+			req.WithOption(OptRequestTag, u.tag, true)
+			req.WithBlock1(blockInit(num, more, 64))
+			data, _ := req.marshalBinary()
+			if _, err := peer.WriteToUDP(data, to); err != nil {
+				t.Fatal(err)
+			}
+
+			_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := peer.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp, err := parseMessage(buf[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if more && rsp.Code != RspCodeContinue {
+				t.Fatalf("upload %x block %d: %s", u.tag, num, rsp.Code.NumberString())
+			}
+			if !more && (rsp.Code != RspCodeChanged || !bytes.Equal(rsp.Payload, u.payload[:1])) {
+				t.Errorf("upload %x: %s with %q", u.tag, rsp.Code.NumberString(), rsp.Payload)
+			}
+		}
+	}
+}
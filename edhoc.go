@@ -0,0 +1,659 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EdhocPath is the resource the EDHOC responder is reached at (RFC 9528
+// appendix A.2).
+const EdhocPath = "/.well-known/edhoc"
+
+// EDHOC method 3, both parties authenticate with static DH keys, and cipher
+// suite 2: AES-CCM-16-64-128, SHA-256, 8 byte MACs and P-256.
+const (
+	edhocMethod         = 3
+	edhocSuite          = 2
+	edhocHashLen        = 32
+	edhocMacLen         = 8
+	edhocKeyLen         = 16
+	edhocIVLen          = 13
+	edhocPointLen       = 32
+	edhocSessionTimeout = time.Minute
+	edhocMaxSessions    = 64
+)
+
+// EDHOC error codes (RFC 9528 section 6).
+const (
+	edhocErrUnspecified = 1
+	edhocErrWrongSuite  = 2
+)
+
+// EdhocCredential is the authentication credential of a party, a CWT Claims
+// Set holding its P-256 static DH key identified by Kid (RFC 9528 section
+// 3.5).
+type EdhocCredential struct {
+	Kid       []byte
+	PublicKey *ecdh.PublicKey
+	// CCS is the encoded credential as provisioned, when nil it is encoded
+	// with just the cnf claim.
+	CCS []byte
+}
+
+// EdhocConfig is what a party authenticates itself and its peers with.
+type EdhocConfig struct {
+	// Key is the P-256 static DH key of the party, Credential its public key.
+	Key        *ecdh.PrivateKey
+	Credential *EdhocCredential
+	// PeerCredential returns the credential of the peer identified by kid,
+	// nil if the peer is not trusted.
+	PeerCredential func(kid []byte) *EdhocCredential
+	// Rand is the source of ephemeral keys and connection identifiers,
+	// crypto/rand.Reader when nil.
+	Rand io.Reader
+}
+
+// edhocSession is the state a responder keeps between message_2 and
+// message_3.
+type edhocSession struct {
+	cI      []byte
+	cR      []byte
+	y       *ecdh.PrivateKey
+	th3     []byte
+	prk3e2m []byte
+	timer   *time.Timer
+}
+
+type edhocResponder struct {
+	server      *Server
+	config      *EdhocConfig
+	established func(oc *OscoreContext, peer *EdhocCredential)
+	sessions    sync.Map
+	pending     atomic.Int32
+}
+
+// encode returns CRED_x, the CWT Claims Set with the key in a cnf claim.
+func (c *EdhocCredential) encode() []byte {
+	if c.CCS != nil {
+		return c.CCS
+	}
+	pub := c.PublicKey.Bytes()
+	b := cborMap(nil, 1)
+	b = cborInt(b, 8) // cnf
+	b = cborMap(b, 1)
+	b = cborInt(b, 1) // COSE_Key
+	b = cborMap(b, 5)
+	b = cborInt(b, 1) // kty
+	b = cborInt(b, 2) // EC2
+	b = cborInt(b, 2) // kid
+	b = cborBytes(b, c.Kid)
+	b = cborInt(b, -1) // crv
+	b = cborInt(b, 1)  // P-256
+	b = cborInt(b, -2) // x
+	b = cborBytes(b, pub[1:1+edhocPointLen])
+	b = cborInt(b, -3) // y
+	return cborBytes(b, pub[1+edhocPointLen:])
+}
+
+// idCred returns ID_CRED_x, the kid in a COSE header map.
+func (c *EdhocCredential) idCred() []byte {
+	b := cborMap(nil, 1)
+	b = cborInt(b, 4)
+	return cborBytes(b, c.Kid)
+}
+
+func (config *EdhocConfig) check() error {
+	if config == nil || config.Key == nil || config.Credential == nil || config.PeerCredential == nil {
+		return fmt.Errorf("%w: incomplete configuration", ErrEdhocFailed)
+	}
+	if config.Key.Curve() != ecdh.P256() {
+		return fmt.Errorf("%w: static key is not P-256", ErrEdhocFailed)
+	}
+	return nil
+}
+
+func (config *EdhocConfig) random() io.Reader {
+	if config.Rand == nil {
+		return rand.Reader
+	}
+	return config.Rand
+}
+
+// ephemeral returns a new ephemeral key, the scalar is read from Rand as is so
+// that a given Rand always yields the same key.
+func (config *EdhocConfig) ephemeral() (*ecdh.PrivateKey, error) {
+	b := make([]byte, edhocPointLen)
+	for {
+		if _, err := io.ReadFull(config.random(), b); err != nil {
+			return nil, err
+		}
+		// the few values out of the range of P-256 scalars are skipped
+		if key, err := ecdh.P256().NewPrivateKey(b); err == nil {
+			return key, nil
+		}
+	}
+}
+
+func (config *EdhocConfig) peer(kid []byte) (*EdhocCredential, error) {
+	peer := config.PeerCredential(kid)
+	if peer == nil || peer.PublicKey == nil || peer.PublicKey.Curve() != ecdh.P256() {
+		return nil, ErrEdhocUnknownCredential
+	}
+	return peer, nil
+}
+
+func edhocKDF(prk []byte, label int64, context []byte, length int) []byte {
+	info := cborInt(nil, label)
+	info = cborBytes(info, context)
+	info = cborInt(info, int64(length))
+	return hkdfExpand(prk, info, length)
+}
+
+func edhocHash(items ...[]byte) []byte {
+	h := sha256.New()
+	for _, item := range items {
+		h.Write(item)
+	}
+	return h.Sum(nil)
+}
+
+func edhocXor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// edhocAppendID encodes a connection identifier or kid, a byte string holding
+// a single byte CBOR integer is sent as that integer (RFC 9528 section 3.3.2).
+func edhocAppendID(buf, id []byte) []byte {
+	if len(id) == 1 && (id[0] <= 0x17 || (id[0] >= 0x20 && id[0] <= 0x37)) {
+		return append(buf, id[0])
+	}
+	return cborBytes(buf, id)
+}
+
+func edhocReadID(r *cborReader) ([]byte, error) {
+	major, err := r.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case cborMajorUint, cborMajorNint:
+		b := r.b[0]
+		if b&0x1f >= 24 {
+			return nil, errCborMalformed
+		}
+		r.b = r.b[1:]
+		return []byte{b}, nil
+	case cborMajorBytes:
+		return r.bytes()
+	}
+	return nil, errCborMalformed
+}
+
+// edhocReadIDCred reads the kid of ID_CRED_x, sent compact or as a header map.
+func edhocReadIDCred(r *cborReader) ([]byte, error) {
+	major, err := r.peek()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMajorMap {
+		return edhocReadID(r)
+	}
+	if _, n, err := r.head(); err != nil || n != 1 {
+		return nil, errCborMalformed
+	}
+	if label, err := r.int(); err != nil || label != 4 {
+		return nil, errCborMalformed
+	}
+	return r.bytes()
+}
+
+// edhocSkipEAD skips the external authorization data at the end of a message,
+// none is supported so critical items fail the exchange.
+func edhocSkipEAD(r *cborReader) error {
+	for !r.empty() {
+		label, err := r.int()
+		if err != nil {
+			return err
+		}
+		if label < 0 {
+			return fmt.Errorf("%w: critical ead item %d not supported", ErrEdhocFailed, -label)
+		}
+		if major, err := r.peek(); err == nil && major == cborMajorBytes {
+			if _, err := r.bytes(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// edhocPublicKey restores the P-256 point from its x-coordinate, either y
+// gives the same shared secret (RFC 9528 section 3.7).
+func edhocPublicKey(x []byte) (*ecdh.PublicKey, error) {
+	if len(x) != edhocPointLen {
+		return nil, errCborMalformed
+	}
+	params := elliptic.P256().Params()
+	xi := new(big.Int).SetBytes(x)
+	rhs := new(big.Int).Exp(xi, big.NewInt(3), params.P)
+	rhs.Sub(rhs, new(big.Int).Mul(xi, big.NewInt(3)))
+	rhs.Add(rhs, params.B)
+	rhs.Mod(rhs, params.P)
+	y := new(big.Int).ModSqrt(rhs, params.P)
+	if y == nil {
+		return nil, fmt.Errorf("%w: invalid ephemeral key", ErrEdhocFailed)
+	}
+	point := make([]byte, 1+2*edhocPointLen)
+	point[0] = 4
+	xi.FillBytes(point[1 : 1+edhocPointLen])
+	y.FillBytes(point[1+edhocPointLen:])
+	return ecdh.P256().NewPublicKey(point)
+}
+
+// edhocA3 is the additional data of message_3 (RFC 9528 section 5.4.2).
+func edhocA3(th3 []byte) []byte {
+	b := cborArray(nil, 3)
+	b = cborText(b, "Encrypt0")
+	b = cborBytes(b, nil)
+	return cborBytes(b, th3)
+}
+
+// edhocOscore derives the OSCORE security context from PRK_out (RFC 9528
+// appendix A.1), the sender ID of each party is the connection identifier
+// chosen by the other.
+func edhocOscore(prkOut, senderID, recipientID []byte) (*OscoreContext, error) {
+	exporter := edhocKDF(prkOut, 10, nil, edhocHashLen)
+	secret := edhocKDF(exporter, 0, nil, oscoreKeyLen)
+	salt := edhocKDF(exporter, 1, nil, 8)
+	return NewOscoreContext(secret, salt, senderID, recipientID, nil)
+}
+
+// edhocConnID picks a connection identifier that is not in use as an OSCORE
+// recipient ID, preferring the compact single byte ones.
+func (s *Server) edhocConnID(r io.Reader, inUse func(id []byte) bool) ([]byte, error) {
+	b := make([]byte, 4)
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		id := append([]byte{}, b...)
+		if i < 16 {
+			id = []byte{b[0] % 48}
+			if id[0] >= 24 {
+				id[0] += 8
+			}
+		}
+		s.oscoreMux.RLock()
+		_, used := s.oscoreRecipients[oscoreKey{id: string(id)}]
+		s.oscoreMux.RUnlock()
+		if !used && !inUse(id) {
+			return id, nil
+		}
+	}
+}
+
+// edhocResponseError returns the error in an EDHOC error message, or the one
+// of the response code.
+func edhocResponseError(rsp *Message) error {
+	if rsp.ContentFormat() == AppEdhocCBOR {
+		r := &cborReader{b: rsp.Payload}
+		switch code, _ := r.int(); code {
+		case edhocErrUnspecified:
+			info, _ := r.text()
+			return fmt.Errorf("%w: %s", ErrEdhocFailed, info)
+		case edhocErrWrongSuite:
+			return fmt.Errorf("%w: cipher suite %d not supported by peer", ErrEdhocFailed, edhocSuite)
+		}
+	}
+	if err := ResponseToError(rsp); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: unexpected response %s", ErrEdhocFailed, rsp.Code)
+}
+
+// EdhocInitiate runs EDHOC as initiator with the responder at addr and adds
+// the resulting OSCORE context for requests sent to addr.
+func (s *Server) EdhocInitiate(ctx context.Context, addr string, config *EdhocConfig, options *SendOptions) (*OscoreContext, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	x, err := config.ephemeral()
+	if err != nil {
+		return nil, err
+	}
+	gx := x.PublicKey().Bytes()[1 : 1+edhocPointLen]
+	cI, err := s.edhocConnID(config.random(), func(id []byte) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+
+	// message_1
+	m1 := cborInt(nil, edhocMethod)
+	m1 = cborInt(m1, edhocSuite)
+	m1 = cborBytes(m1, gx)
+	m1 = edhocAppendID(m1, cI)
+	msg := NewMessage().WithType(TypeConfirmable).WithCode(CodePost).WithPathString(EdhocPath).
+		WithContentFormat(AppCidEdhoc).WithPayload(append([]byte{cborTrue}, m1...))
+	// EDHOC messages are never protected with the OSCORE context of the peer,
+	// which may be stale at the responder when re-keying
+	rsp, err := s.sendPlain(ctx, addr, msg, options)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Code != RspCodeChanged {
+		return nil, edhocResponseError(rsp)
+	}
+
+	// message_2
+	r := &cborReader{b: rsp.Payload}
+	gyc, err := r.bytes()
+	if err != nil || !r.empty() || len(gyc) <= edhocPointLen {
+		return nil, fmt.Errorf("%w: malformed message_2", ErrEdhocFailed)
+	}
+	gy, ct2 := gyc[:edhocPointLen], gyc[edhocPointLen:]
+	y, err := edhocPublicKey(gy)
+	if err != nil {
+		return nil, err
+	}
+	gxy, err := x.ECDH(y)
+	if err != nil {
+		return nil, err
+	}
+	th2 := edhocHash(cborBytes(nil, gy), cborBytes(nil, edhocHash(m1)))
+	prk2e := hkdfExtract(th2, gxy)
+	pt2 := edhocXor(ct2, edhocKDF(prk2e, 0, th2, len(ct2)))
+
+	r = &cborReader{b: pt2}
+	cR, err := edhocReadID(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_2", ErrEdhocFailed)
+	}
+	kidR, err := edhocReadIDCred(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_2", ErrEdhocFailed)
+	}
+	mac2, err := r.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_2", ErrEdhocFailed)
+	}
+	if err := edhocSkipEAD(r); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(cR, cI) {
+		return nil, fmt.Errorf("%w: connection identifiers are equal", ErrEdhocFailed)
+	}
+	peer, err := config.peer(kidR)
+	if err != nil {
+		return nil, err
+	}
+	credR := peer.encode()
+	grx, err := x.ECDH(peer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	prk3e2m := hkdfExtract(edhocKDF(prk2e, 1, th2, edhocHashLen), grx)
+	context2 := edhocAppendID(nil, cR)
+	context2 = append(context2, peer.idCred()...)
+	context2 = cborBytes(context2, th2)
+	context2 = append(context2, credR...)
+	if !hmac.Equal(mac2, edhocKDF(prk3e2m, 2, context2, edhocMacLen)) {
+		return nil, ErrEdhocVerify
+	}
+
+	// message_3
+	th3 := edhocHash(cborBytes(nil, th2), pt2, credR)
+	giy, err := config.Key.ECDH(y)
+	if err != nil {
+		return nil, err
+	}
+	prk4e3m := hkdfExtract(edhocKDF(prk3e2m, 5, th3, edhocHashLen), giy)
+	credI := config.Credential.encode()
+	context3 := append(config.Credential.idCred(), cborBytes(nil, th3)...)
+	context3 = append(context3, credI...)
+	pt3 := edhocAppendID(nil, config.Credential.Kid)
+	pt3 = cborBytes(pt3, edhocKDF(prk4e3m, 6, context3, edhocMacLen))
+	aead, err := oscoreAead(edhocKDF(prk3e2m, 3, th3, edhocKeyLen))
+	if err != nil {
+		return nil, err
+	}
+	ct3 := aead.Seal(nil, edhocKDF(prk3e2m, 4, th3, edhocIVLen), pt3, edhocA3(th3))
+	th4 := edhocHash(cborBytes(nil, th3), pt3, credI)
+	prkOut := edhocKDF(prk4e3m, 7, th4, edhocHashLen)
+
+	msg = NewMessage().WithType(TypeConfirmable).WithCode(CodePost).WithPathString(EdhocPath).
+		WithContentFormat(AppCidEdhoc).WithPayload(cborBytes(edhocAppendID(nil, cR), ct3))
+	rsp, err = s.sendPlain(ctx, addr, msg, options)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Code != RspCodeChanged {
+		return nil, edhocResponseError(rsp)
+	}
+
+	oc, err := edhocOscore(prkOut, cR, cI)
+	if err != nil {
+		return nil, err
+	}
+	s.AddOscoreContext(addr, oc)
+	logDebug(rsp, nil, "edhoc completed with %s", addr)
+	return oc, nil
+}
+
+// EnableEdhoc makes the Server an EDHOC responder at EdhocPath. Each
+// completed exchange adds an OSCORE context for requests from the initiator,
+// which is passed to established unless it is nil.
+func (s *Server) EnableEdhoc(config *EdhocConfig, established func(oc *OscoreContext, peer *EdhocCredential)) error {
+	if err := config.check(); err != nil {
+		return err
+	}
+	r := &edhocResponder{server: s, config: config, established: established}
+	s.AddMethodRoute(CodePost, EdhocPath, r.handle, WithLink(LinkAttributes{ResourceType: []string{"core.edhoc"}}))
+	return nil
+}
+
+func (r *edhocResponder) handle(req *Message) *Message {
+	var rsp *Message
+	var err error
+	if len(req.Payload) > 0 && req.Payload[0] == cborTrue {
+		rsp, err = r.message1(req, req.Payload[1:])
+	} else {
+		rsp, err = r.message3(req)
+	}
+	if err != nil {
+		logWarn(req, err, "coap: edhoc failed")
+		rsp = req.MakeReply(RspCodeBadRequest, cborText(cborInt(nil, edhocErrUnspecified), err.Error()))
+		rsp.WithContentFormat(AppEdhocCBOR)
+	}
+	return rsp
+}
+
+func (r *edhocResponder) message1(req *Message, m1 []byte) (*Message, error) {
+	cr := &cborReader{b: m1}
+	if method, err := cr.int(); err != nil || method != edhocMethod {
+		return nil, fmt.Errorf("%w: method not supported", ErrEdhocFailed)
+	}
+	// SUITES_I is the selected suite or an array ending with it
+	suite := int64(-1)
+	if major, _ := cr.peek(); major == cborMajorArray {
+		_, n, err := cr.head()
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("%w: malformed message_1", ErrEdhocFailed)
+		}
+		for ; n > 0; n-- {
+			if suite, err = cr.int(); err != nil {
+				return nil, fmt.Errorf("%w: malformed message_1", ErrEdhocFailed)
+			}
+		}
+	} else {
+		suite, _ = cr.int()
+	}
+	if suite != edhocSuite {
+		rsp := req.MakeReply(RspCodeBadRequest, cborInt(cborInt(nil, edhocErrWrongSuite), edhocSuite))
+		rsp.WithContentFormat(AppEdhocCBOR)
+		return rsp, nil
+	}
+	gx, err := cr.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_1", ErrEdhocFailed)
+	}
+	cI, err := edhocReadID(cr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_1", ErrEdhocFailed)
+	}
+	if err := edhocSkipEAD(cr); err != nil {
+		return nil, err
+	}
+	x, err := edhocPublicKey(gx)
+	if err != nil {
+		return nil, err
+	}
+
+	// message_2
+	y, err := r.config.ephemeral()
+	if err != nil {
+		return nil, err
+	}
+	gy := y.PublicKey().Bytes()[1 : 1+edhocPointLen]
+	gxy, err := y.ECDH(x)
+	if err != nil {
+		return nil, err
+	}
+	grx, err := r.config.Key.ECDH(x)
+	if err != nil {
+		return nil, err
+	}
+	cR, err := r.server.edhocConnID(r.config.random(), func(id []byte) bool {
+		_, pending := r.sessions.Load(string(id))
+		return pending || bytes.Equal(id, cI)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	th2 := edhocHash(cborBytes(nil, gy), cborBytes(nil, edhocHash(m1)))
+	prk2e := hkdfExtract(th2, gxy)
+	prk3e2m := hkdfExtract(edhocKDF(prk2e, 1, th2, edhocHashLen), grx)
+	credR := r.config.Credential.encode()
+	context2 := edhocAppendID(nil, cR)
+	context2 = append(context2, r.config.Credential.idCred()...)
+	context2 = cborBytes(context2, th2)
+	context2 = append(context2, credR...)
+	pt2 := edhocAppendID(nil, cR)
+	pt2 = edhocAppendID(pt2, r.config.Credential.Kid)
+	pt2 = cborBytes(pt2, edhocKDF(prk3e2m, 2, context2, edhocMacLen))
+	ct2 := edhocXor(pt2, edhocKDF(prk2e, 0, th2, len(pt2)))
+
+	if r.pending.Add(1) > edhocMaxSessions {
+		r.pending.Add(-1)
+		return nil, fmt.Errorf("%w: too many pending exchanges", ErrEdhocFailed)
+	}
+	session := &edhocSession{
+		cI:      cI,
+		cR:      cR,
+		y:       y,
+		th3:     edhocHash(cborBytes(nil, th2), pt2, credR),
+		prk3e2m: prk3e2m,
+	}
+	session.timer = time.AfterFunc(edhocSessionTimeout, func() {
+		if r.sessions.CompareAndDelete(string(cR), session) {
+			r.pending.Add(-1)
+		}
+	})
+	r.sessions.Store(string(cR), session)
+
+	rsp := req.MakeReply(RspCodeChanged, cborBytes(nil, append(append([]byte{}, gy...), ct2...)))
+	rsp.WithContentFormat(AppEdhocCBOR)
+	return rsp, nil
+}
+
+func (r *edhocResponder) message3(req *Message) (*Message, error) {
+	cr := &cborReader{b: req.Payload}
+	cR, err := edhocReadID(cr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_3", ErrEdhocFailed)
+	}
+	// the session is only ended by a verified message_3, a forged one must
+	// not cancel the exchange
+	sessionI, found := r.sessions.Load(string(cR))
+	if !found {
+		return nil, fmt.Errorf("%w: unknown connection identifier", ErrEdhocFailed)
+	}
+	session := sessionI.(*edhocSession)
+	ct3, err := cr.bytes()
+	if err != nil || !cr.empty() {
+		return nil, fmt.Errorf("%w: malformed message_3", ErrEdhocFailed)
+	}
+
+	aead, err := oscoreAead(edhocKDF(session.prk3e2m, 3, session.th3, edhocKeyLen))
+	if err != nil {
+		return nil, err
+	}
+	pt3, err := aead.Open(nil, edhocKDF(session.prk3e2m, 4, session.th3, edhocIVLen), ct3, edhocA3(session.th3))
+	if err != nil {
+		return nil, fmt.Errorf("%w: message_3 decryption failed", ErrEdhocFailed)
+	}
+	cr = &cborReader{b: pt3}
+	kidI, err := edhocReadIDCred(cr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_3", ErrEdhocFailed)
+	}
+	mac3, err := cr.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed message_3", ErrEdhocFailed)
+	}
+	if err := edhocSkipEAD(cr); err != nil {
+		return nil, err
+	}
+	peer, err := r.config.peer(kidI)
+	if err != nil {
+		return nil, err
+	}
+	credI := peer.encode()
+	giy, err := session.y.ECDH(peer.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	prk4e3m := hkdfExtract(edhocKDF(session.prk3e2m, 5, session.th3, edhocHashLen), giy)
+	context3 := append(peer.idCred(), cborBytes(nil, session.th3)...)
+	context3 = append(context3, credI...)
+	if !hmac.Equal(mac3, edhocKDF(prk4e3m, 6, context3, edhocMacLen)) {
+		return nil, ErrEdhocVerify
+	}
+	if !r.sessions.CompareAndDelete(string(cR), session) {
+		return nil, fmt.Errorf("%w: unknown connection identifier", ErrEdhocFailed)
+	}
+	session.timer.Stop()
+	r.pending.Add(-1)
+	th4 := edhocHash(cborBytes(nil, session.th3), pt3, credI)
+	prkOut := edhocKDF(prk4e3m, 7, th4, edhocHashLen)
+
+	oc, err := edhocOscore(prkOut, session.cI, session.cR)
+	if err != nil {
+		return nil, err
+	}
+	r.server.AddOscoreContext("", oc)
+	logDebug(req, nil, "edhoc completed")
+	if r.established != nil {
+		r.established(oc, peer)
+	}
+	return req.MakeReply(RspCodeChanged, nil), nil
+}
@@ -0,0 +1,249 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func newTestEdhocConfig(t *testing.T, kid []byte) *EdhocConfig {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &EdhocConfig{Key: key, Credential: &EdhocCredential{Kid: kid, PublicKey: key.PublicKey()}}
+}
+
+// trustEdhoc makes a and b accept each others credential.
+func trustEdhoc(a, b *EdhocConfig) {
+	a.PeerCredential = func(kid []byte) *EdhocCredential {
+		if bytes.Equal(kid, b.Credential.Kid) {
+			return b.Credential
+		}
+		return nil
+	}
+	b.PeerCredential = func(kid []byte) *EdhocCredential {
+		if bytes.Equal(kid, a.Credential.Kid) {
+			return a.Credential
+		}
+		return nil
+	}
+}
+
+// edhocPair returns an initiator and a responder with EDHOC enabled on a route
+// that answers with the OSCORE recipient ID of the request.
+func edhocPair(t *testing.T) (initiator, responder *Server, iconf, rconf *EdhocConfig, established chan *OscoreContext) {
+	iconf = newTestEdhocConfig(t, []byte{0x2b})
+	rconf = newTestEdhocConfig(t, []byte{0x32})
+	trustEdhoc(iconf, rconf)
+	responder = newTestServer(t, nil)
+	established = make(chan *OscoreContext, 4)
+	if err := responder.EnableEdhoc(rconf, func(oc *OscoreContext, peer *EdhocCredential) {
+		established <- oc
+	}); err != nil {
+		t.Fatal(err)
+	}
+	responder.AddRoute("secret", func(req *Message) *Message {
+		oc := req.OscoreContext()
+		if oc == nil {
+			return req.MakeReply(RspCodeUnauthorized, nil)
+		}
+		return req.MakeReply(RspCodeContent, oc.RecipientID)
+	})
+	return newTestServer(t, nil), responder, iconf, rconf, established
+}
+
+func edhocGetSecret(t *testing.T, s *Server, addr string) *Message {
+	t.Helper()
+	rsp, err := s.Send(addr, newTestRequest(TypeConfirmable, CodeGet, "secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp
+}
+
+func TestEdhocLoopback(t *testing.T) {
+	initiator, responder, iconf, _, established := edhocPair(t)
+	addr := responder.udpListener.LocalAddr()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	oc, err := initiator.EdhocInitiate(ctx, addr, iconf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roc *OscoreContext
+	select {
+	case roc = <-established:
+	case <-time.After(time.Second):
+		t.Fatal("responder did not complete")
+	}
+	if !bytes.Equal(oc.SenderID, roc.RecipientID) || !bytes.Equal(oc.RecipientID, roc.SenderID) {
+		t.Fatalf("context ids do not match: %x/%x and %x/%x", oc.SenderID, oc.RecipientID, roc.SenderID, roc.RecipientID)
+	}
+	if rsp := edhocGetSecret(t, initiator, addr); rsp.Code != RspCodeContent || !bytes.Equal(rsp.Payload, oc.SenderID) {
+		t.Fatalf("unexpected protected response %v %x", rsp.Code, rsp.Payload)
+	}
+}
+
+func TestEdhocUntrustedPeer(t *testing.T) {
+	initiator, responder, iconf, _, _ := edhocPair(t)
+	iconf.PeerCredential = func(kid []byte) *EdhocCredential { return nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := initiator.EdhocInitiate(ctx, responder.udpListener.LocalAddr(), iconf, nil); err != ErrEdhocUnknownCredential {
+		t.Fatalf("expected %v, got %v", ErrEdhocUnknownCredential, err)
+	}
+}
+
+// TestEdhocRekey runs EDHOC again after the responder lost its contexts, the
+// messages must not be protected with the stale context of the initiator.
+func TestEdhocRekey(t *testing.T) {
+	initiator, responder, iconf, _, established := edhocPair(t)
+	addr := responder.udpListener.LocalAddr()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := initiator.EdhocInitiate(ctx, addr, iconf, nil); err != nil {
+		t.Fatal(err)
+	}
+	responder.RemoveOscoreContext(<-established)
+	if rsp := edhocGetSecret(t, initiator, addr); rsp.Code != RspCodeUnauthorized {
+		t.Fatalf("expected 4.01 with the dropped context, got %v", rsp.Code)
+	}
+
+	oc, err := initiator.EdhocInitiate(ctx, addr, iconf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp := edhocGetSecret(t, initiator, addr); rsp.Code != RspCodeContent || !bytes.Equal(rsp.Payload, oc.SenderID) {
+		t.Fatalf("unexpected protected response %v %x", rsp.Code, rsp.Payload)
+	}
+}
+
+// edhocTraceCredential is a credential of RFC 9529 section 3, a CCS with a
+// subject and the static key of the party.
+func edhocTraceCredential(t *testing.T, subject string, kid byte, private string) (*ecdh.PrivateKey, *EdhocCredential) {
+	key, err := ecdh.P256().NewPrivateKey(mustHex(t, private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccs := cborMap(nil, 2)
+	ccs = cborInt(ccs, 2) // sub
+	ccs = cborText(ccs, subject)
+	c := &EdhocCredential{Kid: []byte{kid}, PublicKey: key.PublicKey()}
+	c.CCS = append(ccs, c.encode()[1:]...)
+	return key, c
+}
+
+// TestEdhocTrace runs the responder through the trace of RFC 9529 section 3,
+// method 3 with cipher suite 2, with its ephemeral key and C_R from Rand.
+func TestEdhocTrace(t *testing.T) {
+	keyR, credR := edhocTraceCredential(t, "example.edu", 0x32, "72cc4761dbd4c78f758931aa589d348d1ef874a7e303ede2f140dcf3e6aa4aac")
+	_, credI := edhocTraceCredential(t, "42-50-31-FF-EF-37-32-39", 0x2b, "fb13adeb6518cee5f88417660841142e830a81fe334380a953406a1305e8706b")
+	if want := "a2026b6578616d706c652e65647508a101a501020241322001215820bbc34960526ea4d32e940cad2a234148ddc21791a12afbcbac93622046dd44f02258204519e257236b2a0ce2023f0931f1f386ca7afda64fcde0108c224c51eabf6072"; !bytes.Equal(credR.CCS, mustHex(t, want)) {
+		t.Fatalf("CRED_R %x", credR.CCS)
+	}
+
+	// Y, then the random bytes edhocConnID turns into C_R = -8
+	rnd := append(mustHex(t, "e2f4126777205e853b437d6eaca1e1f753cdcc3e2c69fa884b0a1a640977e418"), 31, 0, 0, 0)
+	var established *OscoreContext
+	r := &edhocResponder{
+		server: newTestServer(t, nil),
+		config: &EdhocConfig{Key: keyR, Credential: credR, Rand: bytes.NewReader(rnd), PeerCredential: func(kid []byte) *EdhocCredential {
+			if bytes.Equal(kid, credI.Kid) {
+				return credI
+			}
+			return nil
+		}},
+		established: func(oc *OscoreContext, peer *EdhocCredential) { established = oc },
+	}
+
+	req := newTestRequest(TypeConfirmable, CodePost, EdhocPath)
+	req.Payload = append([]byte{cborTrue}, mustHex(t, "0382060258208af6f430ebe18d34184017a9a11bf511c8dff8f834730b96c1b7c8dbca2fc3b637")...)
+	rsp := r.handle(req)
+	if want := mustHex(t, "582b419701d7f00a26c2dc587a36dd752549f33763c893422c8ea0f955a13a4ff5d59862a1eef9e0e7e1886fcd"); rsp.Code != RspCodeChanged || !bytes.Equal(rsp.Payload, want) {
+		t.Fatalf("message_2 %v %x", rsp.Code, rsp.Payload)
+	}
+
+	// a forged message_3 for C_R does not end the exchange
+	req.Payload = mustHex(t, "2752000000000000000000000000000000000000")
+	if rsp = r.handle(req); rsp.Code != RspCodeBadRequest {
+		t.Fatalf("forged message_3 answered with %v", rsp.Code)
+	}
+
+	// C_R and message_3
+	req.Payload = mustHex(t, "2752e562097bc417dd5919485ac7891ffd90a9fc")
+	if rsp = r.handle(req); rsp.Code != RspCodeChanged || established == nil {
+		t.Fatalf("message_3 answered with %v %q", rsp.Code, rsp.Payload)
+	}
+	// the OSCORE master secret and salt of the trace
+	want, _ := NewOscoreContext(mustHex(t, "f9868f6a3aca78a05d1485b35030b162"), mustHex(t, "ada24c7dbfc85eeb"), []byte{0x37}, []byte{0x27}, nil)
+	if !bytes.Equal(established.SenderID, want.SenderID) || !bytes.Equal(established.RecipientID, want.RecipientID) || !bytes.Equal(established.commonIV, want.commonIV) {
+		t.Fatalf("oscore context %x/%x iv %x", established.SenderID, established.RecipientID, established.commonIV)
+	}
+	nonce := want.nonce(want.SenderID, []byte{0})
+	if !bytes.Equal(established.senderAead.Seal(nil, nonce, []byte("x"), nil), want.senderAead.Seal(nil, nonce, []byte("x"), nil)) {
+		t.Fatal("oscore sender key differs from the trace")
+	}
+}
+
+func TestEdhocMalformed(t *testing.T) {
+	_, responder, _, _, _ := edhocPair(t)
+	r := &edhocResponder{server: responder, config: newTestEdhocConfig(t, []byte{1})}
+	r.config.PeerCredential = func(kid []byte) *EdhocCredential { return nil }
+	for _, payload := range []string{
+		"",
+		"f5",
+		"f503",
+		"f50302",
+		"f5030241",
+		"f503025820",
+		"f503065820",
+		"f5038106",
+		"f50380",
+		"27",
+		"2743",
+		"1818",
+		"27410000",
+	} {
+		req := newTestRequest(TypeConfirmable, CodePost, EdhocPath)
+		req.Payload = mustHex(t, payload)
+		if rsp := r.handle(req); rsp.Code != RspCodeBadRequest {
+			t.Errorf("%s answered with %v", payload, rsp.Code)
+		}
+	}
+}
+
+func TestEdhocSessionLimit(t *testing.T) {
+	_, responder, _, rconf, _ := edhocPair(t)
+	r := &edhocResponder{server: responder, config: rconf}
+	for i := 0; i <= edhocMaxSessions; i++ {
+		x, err := rconf.ephemeral()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m1 := cborInt(nil, edhocMethod)
+		m1 = cborInt(m1, edhocSuite)
+		m1 = cborBytes(m1, x.PublicKey().Bytes()[1:1+edhocPointLen])
+		m1 = edhocAppendID(m1, []byte{byte(i)})
+		req := newTestRequest(TypeConfirmable, CodePost, EdhocPath)
+		req.Payload = append([]byte{cborTrue}, m1...)
+		want := RspCodeChanged
+		if i == edhocMaxSessions {
+			want = RspCodeBadRequest
+		}
+		if rsp := r.handle(req); rsp.Code != want {
+			t.Fatalf("message_1 %d answered with %v", i, rsp.Code)
+		}
+	}
+}
@@ -4,39 +4,121 @@
 
 package coap
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
-	ErrTimeout               = errors.New("coap: timeout")
-	ErrBadRequest            = errors.New("coap: bad request")
-	ErrNotFound              = errors.New("coap: not found")
-	ErrUnauthorized          = errors.New("coap: not authorized")
-	ErrMethodNotAllowed      = errors.New("coap: method not allowed")
-	ErrEncodingNotAcceptable = errors.New("coap: encoding not acceptable")
-	ErrInternalServerError   = errors.New("coap: internal server error")
-	ErrInvalidTokenLen       = errors.New("coap: invalid token length")
-	ErrOptionTooLong         = errors.New("coap: option is too long")
-	ErrOptionGapTooLarge     = errors.New("coap: option gap too large")
+	ErrTimeout                 = errors.New("coap: timeout")
+	ErrReset                   = errors.New("coap: reset by peer")
+	ErrServerClosed            = errors.New("coap: server closed")
+	ErrBadRequest              = errors.New("coap: bad request")
+	ErrUnauthorized            = errors.New("coap: not authorized")
+	ErrBadOption               = errors.New("coap: bad option")
+	ErrForbidden               = errors.New("coap: forbidden")
+	ErrNotFound                = errors.New("coap: not found")
+	ErrMethodNotAllowed        = errors.New("coap: method not allowed")
+	ErrEncodingNotAcceptable   = errors.New("coap: encoding not acceptable")
+	ErrRequestEntityIncomplete = errors.New("coap: request entity incomplete")
+	ErrPreconditionFailed      = errors.New("coap: precondition failed")
+	ErrRequestEntityTooLarge   = errors.New("coap: request entity too large")
+	ErrUnsupportedMediaType    = errors.New("coap: unsupported content format")
+	ErrInternalServerError     = errors.New("coap: internal server error")
+	ErrNotImplemented          = errors.New("coap: not implemented")
+	ErrBadGateway              = errors.New("coap: bad gateway")
+	ErrServiceUnavailable      = errors.New("coap: service unavailable")
+	ErrGatewayTimeout          = errors.New("coap: gateway timeout")
+	ErrProxyingNotSupported    = errors.New("coap: proxying not supported")
+	ErrInvalidTokenLen         = errors.New("coap: invalid token length")
+	ErrOptionTooLong           = errors.New("coap: option is too long")
+	ErrOptionGapTooLarge       = errors.New("coap: option gap too large")
+	ErrMessageTooLarge         = errors.New("coap: message exceeds maximum size")
+	ErrInvalidURI              = errors.New("coap: invalid uri")
+	ErrOscoreInvalidID         = errors.New("coap: oscore sender or recipient id too long")
+	ErrOscoreBadOption         = errors.New("coap: invalid oscore option")
+	ErrOscoreContextNotFound   = errors.New("coap: oscore security context not found")
+	ErrOscoreDecrypt           = errors.New("coap: oscore decryption failed")
+	ErrOscoreReplay            = errors.New("coap: oscore replay detected")
+	ErrOscoreSequenceExhausted = errors.New("coap: oscore sender sequence number exhausted")
+	ErrOscoreUnprotected       = errors.New("coap: oscore response not protected")
+	ErrEdhocFailed             = errors.New("coap: edhoc failed")
+	ErrEdhocUnknownCredential  = errors.New("coap: edhoc peer credential unknown")
+	ErrEdhocVerify             = errors.New("coap: edhoc mac verification failed")
 )
 
+var rspCodeErrors = map[COAPCode]error{
+	RspCodeBadRequest:              ErrBadRequest,
+	RspCodeUnauthorized:            ErrUnauthorized,
+	RspCodeBadOption:               ErrBadOption,
+	RspCodeForbidden:               ErrForbidden,
+	RspCodeNotFound:                ErrNotFound,
+	RspCodeMethodNotAllowed:        ErrMethodNotAllowed,
+	RspCodeNotAcceptable:           ErrEncodingNotAcceptable,
+	RspCodeRequestEntityIncomplete: ErrRequestEntityIncomplete,
+	RspCodePreconditionFailed:      ErrPreconditionFailed,
+	RspCodeRequestEntityTooLarge:   ErrRequestEntityTooLarge,
+	RspCodeUnsupportedMediaType:    ErrUnsupportedMediaType,
+	RspCodeInternalServerError:     ErrInternalServerError,
+	RspCodeNotImplemented:          ErrNotImplemented,
+	RspCodeBadGateway:              ErrBadGateway,
+	RspCodeServiceUnavailable:      ErrServiceUnavailable,
+	RspCodeGatewayTimeout:          ErrGatewayTimeout,
+	RspCodeProxyingNotSupported:    ErrProxyingNotSupported,
+}
+
+// RspCodeToError returns the error for a 4.xx or 5.xx response code, nil for
+// other codes. ResponseToError keeps the details of the response.
 func RspCodeToError(code COAPCode) error {
 	if code < 100 {
 		return nil
 	}
-	switch code {
-	case RspCodeBadRequest:
-		return ErrBadRequest
-	case RspCodeNotFound:
-		return ErrNotFound
-	case RspCodeUnauthorized:
-		return ErrUnauthorized
-	case RspCodeMethodNotAllowed:
-		return ErrMethodNotAllowed
-	case RspCodeNotAcceptable:
-		return ErrEncodingNotAcceptable
-	case RspCodeInternalServerError:
-		return ErrInternalServerError
-	default:
-		return errors.New("coap: other error " + code.String())
+	if err, found := rspCodeErrors[code]; found {
+		return err
+	}
+	return errors.New("coap: other error " + code.String())
+}
+
+// ResponseError is the error for a response with a 4.xx or 5.xx code, it
+// matches the Err sentinel of its code with errors.Is.
+type ResponseError struct {
+	Code COAPCode
+	// Message is the response.
+	Message *Message
+	// Diagnostic is the diagnostic payload of a response without a content
+	// format (RFC 7252 section 5.5.2).
+	Diagnostic string
+	// MaxAge is how long the response stays fresh, a 5.03 asks the client to
+	// retry after it (RFC 7252 section 5.9.3.4).
+	MaxAge time.Duration
+}
+
+// ResponseToError returns a *ResponseError for a 4.xx or 5.xx response, nil
+// for other responses.
+func ResponseToError(rsp *Message) error {
+	if rsp == nil || rsp.Code < 100 {
+		return nil
+	}
+	e := &ResponseError{Code: rsp.Code, Message: rsp, MaxAge: time.Second * 60}
+	if rsp.ContentFormat() == None {
+		e.Diagnostic = string(rsp.Payload)
+	}
+	if ma := rsp.Option(OptMaxAge); ma != nil {
+		e.MaxAge = time.Duration(optionUint(ma)) * time.Second
+	}
+	return e
+}
+
+func (e *ResponseError) Error() string {
+	msg := RspCodeToError(e.Code).Error()
+	if len(e.Diagnostic) != 0 {
+		msg += ": " + e.Diagnostic
 	}
+	return msg
+}
+
+// Is reports whether target is the Err sentinel of the response code.
+func (e *ResponseError) Is(target error) bool {
+	err, found := rspCodeErrors[e.Code]
+	return found && err == target
 }
@@ -5,11 +5,14 @@ go 1.20
 //replace github.com/qwerty-iot/dtls/v2 => ../dtls
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/qwerty-iot/dtls/v2 v2.9.5
 	github.com/qwerty-iot/tox v1.4.3
+	golang.org/x/net v0.33.0
 )
 
 require (
 	dario.cat/mergo v1.0.2 // indirect
 	github.com/goccy/go-json v0.10.5 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 )
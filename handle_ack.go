@@ -5,22 +5,66 @@
 package coap
 
 type pendingEntry struct {
-	c chan *Message
+	c    chan *Message
+	done func(rsp *Message)
+	mid  uint16
+	// multi entries take any number of responses, until deleted
+	multi bool
 }
 
 func (s *Server) pendingSave(msg *Message) chan *Message {
-	pe := &pendingEntry{}
-	pe.c = make(chan *Message, 1)
-	if len(msg.Token) == 0 {
+	pe := &pendingEntry{c: make(chan *Message, 1)}
+	s.pendingAdd(msg, pe)
+	return pe.c
+}
+
+// pendingSaveFunc is pendingSave that hands the answer to done, which must
+// not block.
+func (s *Server) pendingSaveFunc(msg *Message, done func(rsp *Message)) {
+	s.pendingAdd(msg, &pendingEntry{done: done})
+}
+
+// pendingSaveMulti is pendingSaveFunc for a multicast request, which is
+// answered once by each member of the group.
+func (s *Server) pendingSaveMulti(msg *Message, done func(rsp *Message)) {
+	s.pendingAdd(msg, &pendingEntry{done: done, multi: true})
+}
+
+func (s *Server) pendingAdd(msg *Message, pe *pendingEntry) {
+	if len(msg.Token) == 0 && msg.Code != CodeEmpty {
 		msg.Token = []byte(randomString(8))
 	}
 	s.pendingMux.Lock()
 	msg.MessageID = s.pendingMsgId
 	s.pendingMsgId = s.pendingMsgId + 1
+	pe.mid = msg.MessageID
 	s.pendingMap[string(msg.Token)] = pe
 	s.pendingMidMap[msg.MessageID] = pe
 	s.pendingMux.Unlock()
-	return pe.c
+}
+
+func (pe *pendingEntry) deliver(rsp *Message) {
+	if pe.done != nil {
+		pe.done(rsp)
+		return
+	}
+	select {
+	case pe.c <- rsp:
+	default:
+		logDebug(rsp, nil, "ack on closed channel (removed from pending list)")
+	}
+}
+
+// pendingDelete forgets an exchange that will not be completed.
+func (s *Server) pendingDelete(msg *Message) {
+	s.pendingMux.Lock()
+	if pe, found := s.pendingMap[string(msg.Token)]; found {
+		delete(s.pendingMap, string(msg.Token))
+		if s.pendingMidMap[pe.mid] == pe {
+			delete(s.pendingMidMap, pe.mid)
+		}
+	}
+	s.pendingMux.Unlock()
 }
 
 func (s *Server) handleAcknowledgement(req *Message) bool {
@@ -38,31 +82,22 @@ func (s *Server) handleAcknowledgement(req *Message) bool {
 			return false
 		}
 
-		select {
-		case pe.c <- req:
-			//logDebug(req, nil, "ack found (removed from pending list)")
-		default:
-			logDebug(req, nil, "empty ack on closed channel (removed from pending list)")
-		}
-		//logDebug(req, nil, "empty ack")
+		pe.deliver(req)
 		return true
 	}
 
 	s.pendingMux.Lock()
 	pe, found := s.pendingMap[string(req.Token)]
-	if found {
+	if found && !pe.multi {
 		delete(s.pendingMap, string(req.Token))
-		delete(s.pendingMidMap, req.MessageID)
+		if s.pendingMidMap[pe.mid] == pe {
+			delete(s.pendingMidMap, pe.mid)
+		}
 	}
 	s.pendingMux.Unlock()
 
 	if found {
-		select {
-		case pe.c <- req:
-			//logDebug(req, nil, "ack found (removed from pending list)")
-		default:
-			logDebug(req, nil, "ack on closed channel (removed from pending list)")
-		}
+		pe.deliver(req)
 		return true
 	}
 	//logDebug(req, nil, "ack not found")
@@ -12,6 +12,21 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 
 	now := time.Now().UTC()
 	s.lastActivity = now
+	if req.ctx == nil {
+		req.ctx = s.ctx
+	}
+
+	if s.beginHandler() {
+		defer s.endHandler()
+	} else if req.IsRequest() && req.Code != CodeEmpty {
+		// shutting down, responses to exchanges in flight are still handled
+		rsp = req.MakeReply(RspCodeServiceUnavailable, nil)
+		if req.Type == TypeNonConfirmable {
+			rsp.Type = TypeNonConfirmable
+		}
+		rsp.Meta = req.Meta
+		return rsp
+	}
 
 	var dedup *dedupEntry
 	isDup := false
@@ -29,6 +44,18 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 			logDebug(rsp, nil, "sent reply")
 		}
 	}()
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(req, newPanicError(r))
+			if req.deferred != nil {
+				req.deferred.discard()
+			}
+			rsp = internalError(req)
+			if rsp == nil && dedup != nil && !isDup {
+				dedup.save(nil)
+			}
+		}
+	}()
 
 	if s.dtlsListener != nil && req.Meta.ListenerName != s.dtlsListener.name {
 		s.dtlsListener.ClosePeer(req.Meta.RemoteAddr)
@@ -36,19 +63,22 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 
 	if req.Type == TypeReset {
 		logDebug(req, nil, "reset message received")
+		s.handleAcknowledgement(req)
+		s.observeReset(req)
 		return
 	}
 
-	if req.Type == TypeConfirmable || req.Type == TypeNonConfirmable {
+	if (req.Type == TypeConfirmable || req.Type == TypeNonConfirmable) && !req.Meta.Reliable {
 		var ok bool
 		dedup, ok = s.deduplicate(req)
 		if !ok {
-			if dedup.pending {
+			cached, pending := dedup.get()
+			if pending {
 				logDebug(req, nil, "duplicate message, ignoring waiting on response")
 				return
 			}
 			logDebug(req, nil, "duplicate message, cached response returned")
-			rsp = dedup.rsp
+			rsp = cached
 			isDup = true
 			return
 		}
@@ -116,15 +146,17 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 					}
 					return
 				}*/
-		} else if block2.More && block2.Num == 0 {
+		} else if block2.More && block2.Num == 0 && req.Option(OptObserve) != nil {
 			// special case for notifications from observes that require blockwise
-			rsp = req.MakeReply(CodeEmpty, nil)
-			rsp.Token = nil
-			_, err := s.send(req.Meta.RemoteAddr, rsp, s.NewOptions())
-			if err != nil {
-				logError(req, err, "coap: error getting failed to send empty ack to start block2 transfer")
+			if !req.Meta.Reliable {
+				rsp = req.MakeReply(CodeEmpty, nil)
+				rsp.Token = nil
+				_, err := s.send(req.Context(), req.Meta.RemoteAddr, rsp, s.NewOptions())
+				if err != nil {
+					logError(req, err, "coap: error getting failed to send empty ack to start block2 transfer")
+				}
+				rsp = nil
 			}
-			rsp = nil
 			// force query
 			breq, err := s.blockRetreive(req)
 			if err != nil {
@@ -146,6 +178,11 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 	} else if block1 != nil {
 		req.Meta.BlockSize = block1.Size
 	}
+	if req.IsRequest() && req.Code != CodeEmpty && req.Option(OptOscore) != nil {
+		if rsp = s.oscoreUnprotect(req); rsp != nil {
+			return
+		}
+	}
 	switch req.Type {
 	case TypeConfirmable:
 		if !req.IsRequest() {
@@ -166,7 +203,7 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 			rsp = s.handleNotify(req)
 		} else {
 			rsp = s.handleConfirmable(req)
-			if rsp.Type == TypeAcknowledgement {
+			if rsp != nil && rsp.Type == TypeAcknowledgement {
 				rsp.Type = TypeNonConfirmable
 			}
 		}
@@ -181,6 +218,26 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 		}
 	}
 
+	if rsp != nil && req.IsRequest() && rsp.Type != TypeReset && req.suppressesResponse(rsp.Code) {
+		logDebug(req, nil, "response %s suppressed by no-response", rsp.Code.NumberString())
+		rsp = nil
+		if req.Type == TypeConfirmable && !req.Meta.Reliable {
+			// the request is still acknowledged (RFC 7967 section 2)
+			rsp = req.MakeReply(CodeEmpty, nil)
+			rsp.Meta.BlockSize = 0
+		} else if dedup != nil {
+			dedup.save(nil)
+		}
+	}
+
+	if rsp != nil && req.oscore != nil && rsp.Code != CodeEmpty && rsp.Type != TypeReset {
+		var err error
+		if rsp, err = req.oscore.protectResponse(rsp); err != nil {
+			logError(req, err, "coap: error protecting oscore response")
+			rsp = req.MakeReply(RspCodeInternalServerError, nil)
+		}
+	}
+
 	if rsp != nil {
 		bs := s.config.BlockDefaultSize
 		if rsp.Meta.BlockSize != 0 {
@@ -189,10 +246,14 @@ func (s *Server) handleMessage(req *Message) (rsp *Message) {
 			bs = req.Meta.BlockSize
 		}
 
-		if block1 != nil {
+		if block1 != nil && rsp.Code != CodeEmpty {
 			rsp.WithBlock1(block1)
 		}
 
+		if rsp.Meta.MaxMessageSize == 0 {
+			rsp.Meta.MaxMessageSize = req.Meta.MaxMessageSize
+		}
+
 		if rsp.RequiresBlockwise() {
 			//need to send BLOCK2
 			if block2 == nil {
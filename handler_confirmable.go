@@ -29,9 +29,13 @@ func (s *Server) handleConfirmable(req *Message) *Message {
 			rsp = req.MakeReply(RspCodeNotFound, nil)
 		}
 	} else {
-		callback := s.matchRoutes(req)
+		callback := chain(s.middleware, s.matchRoutes(req))
 		if callback != nil {
 			rsp = callback(req)
+			if req.deferred != nil {
+				return req.deferred.ack()
+			}
+			s.observeRequest(req, rsp)
 		} else {
 			rsp = req.MakeReply(RspCodeNotFound, nil)
 		}
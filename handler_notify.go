@@ -39,7 +39,10 @@ func (s *Server) handleNotify(req *Message) *Message {
 		return rsp
 	}
 
-	err := c.callback(req, c.arg)
+	err := c.verify(req)
+	if err == nil {
+		err = c.callback(req, c.arg)
+	}
 	if err != nil {
 		logWarn(nil, err, "coap: error processing observation")
 		rsp = &Message{
@@ -0,0 +1,398 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package linkformat encodes and decodes the CoRE Link Format of RFC 6690,
+// the application/link-format content of resource discovery.
+package linkformat
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrSyntax = errors.New("linkformat: syntax error")
+)
+
+// LinkFormat is a list of links (RFC 6690 section 2).
+type LinkFormat []Link
+
+// Link is a target URI with its attributes in document order. An attribute
+// may appear more than once.
+type Link struct {
+	Target string
+	Attrs  []Attr
+}
+
+// Attr is a link parameter. A Flag attribute has no value, e.g. obs. Quoted
+// forces the value to be written as a quoted-string, values that are not a
+// valid token are always quoted.
+type Attr struct {
+	Name   string
+	Value  string
+	Flag   bool
+	Quoted bool
+}
+
+// NewLink returns a Link to target without attributes.
+func NewLink(target string) *Link {
+	return &Link{Target: target}
+}
+
+// Add appends an attribute with a value, quoted as needed.
+func (l *Link) Add(name string, value string) *Link {
+	l.Attrs = append(l.Attrs, Attr{Name: name, Value: value})
+	return l
+}
+
+// AddQuoted appends an attribute with a quoted-string value.
+func (l *Link) AddQuoted(name string, value string) *Link {
+	l.Attrs = append(l.Attrs, Attr{Name: name, Value: value, Quoted: true})
+	return l
+}
+
+// AddFlag appends an attribute without a value.
+func (l *Link) AddFlag(name string) *Link {
+	l.Attrs = append(l.Attrs, Attr{Name: name, Flag: true})
+	return l
+}
+
+// Has returns true if the link carries the attribute name.
+func (l Link) Has(name string) bool {
+	for _, a := range l.Attrs {
+		if a.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Attr returns the value of the first attribute name.
+func (l Link) Attr(name string) (string, bool) {
+	for _, a := range l.Attrs {
+		if a.Name == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Values returns all values of the attribute name, both from repeated
+// attributes and from space separated values such as rt="a b".
+func (l Link) Values(name string) []string {
+	var values []string
+	for _, a := range l.Attrs {
+		if a.Name == name && !a.Flag {
+			values = append(values, strings.Fields(a.Value)...)
+		}
+	}
+	return values
+}
+
+// Rel returns the relation types of the link.
+func (l Link) Rel() []string {
+	return l.Values("rel")
+}
+
+// ResourceTypes returns the rt attribute values.
+func (l Link) ResourceTypes() []string {
+	return l.Values("rt")
+}
+
+// Interfaces returns the if attribute values.
+func (l Link) Interfaces() []string {
+	return l.Values("if")
+}
+
+// ContentFormats returns the ct attribute values, skipping malformed ones.
+func (l Link) ContentFormats() []int {
+	var cts []int
+	for _, v := range l.Values("ct") {
+		if ct, err := strconv.Atoi(v); err == nil {
+			cts = append(cts, ct)
+		}
+	}
+	return cts
+}
+
+// Size returns the sz attribute, or -1 if it is absent or malformed.
+func (l Link) Size() int {
+	v, found := l.Attr("sz")
+	if !found {
+		return -1
+	}
+	sz, err := strconv.Atoi(v)
+	if err != nil {
+		return -1
+	}
+	return sz
+}
+
+// Observable returns true if the link carries the obs flag.
+func (l Link) Observable() bool {
+	return l.Has("obs")
+}
+
+// Title returns the title attribute.
+func (l Link) Title() string {
+	v, _ := l.Attr("title")
+	return v
+}
+
+// Matches applies a resource discovery query filter (RFC 6690 section 4.1),
+// a value ending with '*' matches by prefix and name href matches the target.
+func (l Link) Matches(name string, value string) bool {
+	var values []string
+	if name == "href" {
+		values = []string{l.Target}
+	} else {
+		values = l.Values(name)
+		if len(values) == 0 && l.Has(name) && len(value) == 0 {
+			// flag attributes match an empty filter value
+			return true
+		}
+	}
+	for _, v := range values {
+		if strings.HasSuffix(value, "*") {
+			if strings.HasPrefix(v, value[:len(value)-1]) {
+				return true
+			}
+		} else if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the links matching the attribute filter, see Link.Matches.
+func (lf LinkFormat) Filter(name string, value string) LinkFormat {
+	var rv LinkFormat
+	for _, l := range lf {
+		if l.Matches(name, value) {
+			rv = append(rv, l)
+		}
+	}
+	return rv
+}
+
+// FilterQuery applies a query of the form "name=value" as used in a
+// /.well-known/core request, an empty query matches every link.
+func (lf LinkFormat) FilterQuery(query string) LinkFormat {
+	if len(query) == 0 {
+		return lf
+	}
+	parts := strings.SplitN(query, "=", 2)
+	if len(parts) == 1 {
+		return lf.Filter(parts[0], "")
+	}
+	return lf.Filter(parts[0], parts[1])
+}
+
+// Find returns the link to target, or nil.
+func (lf LinkFormat) Find(target string) *Link {
+	for i := range lf {
+		if lf[i].Target == target {
+			return &lf[i]
+		}
+	}
+	return nil
+}
+
+// String returns the link in link-format.
+func (l Link) String() string {
+	sb := strings.Builder{}
+	sb.WriteString("<" + l.Target + ">")
+	for _, a := range l.Attrs {
+		sb.WriteString(";" + a.Name)
+		if a.Flag {
+			continue
+		}
+		sb.WriteByte('=')
+		if a.Quoted || !isToken(a.Value) {
+			sb.WriteString(quote(a.Value))
+		} else {
+			sb.WriteString(a.Value)
+		}
+	}
+	return sb.String()
+}
+
+// String returns the links in link-format.
+func (lf LinkFormat) String() string {
+	links := make([]string, len(lf))
+	for i, l := range lf {
+		links[i] = l.String()
+	}
+	return strings.Join(links, ",")
+}
+
+// Marshal encodes the links in link-format.
+func Marshal(lf LinkFormat) []byte {
+	return []byte(lf.String())
+}
+
+// Parse decodes a link-format document.
+func Parse(data []byte) (LinkFormat, error) {
+	p := parser{data: string(data)}
+	var lf LinkFormat
+
+	p.skipSpace()
+	for !p.done() {
+		l, err := p.link()
+		if err != nil {
+			return nil, err
+		}
+		lf = append(lf, l)
+
+		p.skipSpace()
+		if p.done() {
+			break
+		}
+		if !p.consume(',') {
+			return nil, p.error("expected ','")
+		}
+		p.skipSpace()
+	}
+	return lf, nil
+}
+
+// ParseString decodes a link-format document.
+func ParseString(s string) (LinkFormat, error) {
+	return Parse([]byte(s))
+}
+
+type parser struct {
+	data string
+	pos  int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *parser) peek() byte {
+	return p.data[p.pos]
+}
+
+func (p *parser) consume(c byte) bool {
+	if !p.done() && p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r' || p.peek() == '\n') {
+		p.pos++
+	}
+}
+
+func (p *parser) error(msg string) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrSyntax, msg, p.pos)
+}
+
+func (p *parser) link() (Link, error) {
+	var l Link
+	if !p.consume('<') {
+		return l, p.error("expected '<'")
+	}
+	end := strings.IndexByte(p.data[p.pos:], '>')
+	if end < 0 {
+		return l, p.error("unterminated target")
+	}
+	l.Target = p.data[p.pos : p.pos+end]
+	p.pos += end + 1
+
+	for {
+		p.skipSpace()
+		if !p.consume(';') {
+			return l, nil
+		}
+		p.skipSpace()
+		a, err := p.attr()
+		if err != nil {
+			return l, err
+		}
+		l.Attrs = append(l.Attrs, a)
+	}
+}
+
+func (p *parser) attr() (Attr, error) {
+	var a Attr
+	start := p.pos
+	for !p.done() && isNameChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		return a, p.error("expected parameter name")
+	}
+	a.Name = p.data[start:p.pos]
+
+	p.skipSpace()
+	if !p.consume('=') {
+		a.Flag = true
+		return a, nil
+	}
+	p.skipSpace()
+
+	if p.consume('"') {
+		sb := strings.Builder{}
+		for {
+			if p.done() {
+				return a, p.error("unterminated quoted-string")
+			}
+			c := p.peek()
+			p.pos++
+			if c == '"' {
+				break
+			}
+			if c == '\\' && !p.done() {
+				c = p.peek()
+				p.pos++
+			}
+			sb.WriteByte(c)
+		}
+		a.Value = sb.String()
+		a.Quoted = true
+		return a, nil
+	}
+
+	start = p.pos
+	for !p.done() && isTokenChar(p.peek()) {
+		p.pos++
+	}
+	a.Value = p.data[start:p.pos]
+	return a, nil
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '!' || c == '#' || c == '$' || c == '&' || c == '+' || c == '-' || c == '.' ||
+		c == '^' || c == '_' || c == '`' || c == '|' || c == '~' || c == '*'
+}
+
+// isTokenChar matches ptokenchar of RFC 5988 section 5.
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'()*+-./:<=>?@[]^_`{|}~", c) >= 0
+}
+
+func isToken(v string) bool {
+	if len(v) == 0 {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if !isTokenChar(v[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func quote(v string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(v) + "\""
+}
@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package linkformat
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"</sensors>",
+		"</sensors/temp>;rt=temperature-c;if=sensor;ct=0;obs",
+		`</sensors/light>;rt="light-lux core.sen-light";if=sensor;sz=1024;title="Light sensor"`,
+		"</a>,</b>;rel=next,</c>;anchor=/b",
+		`</q>;title="say \"hi\"";path="C:\\tmp"`,
+		"</ct>;ct=0;ct=50;ct=60",
+		`</quoted>;rt="token"`,
+	}
+	for _, s := range tests {
+		lf, err := ParseString(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if got := string(Marshal(lf)); got != s {
+			t.Errorf("%q: marshalled as %q", s, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want LinkFormat
+	}{
+		{"</a>", LinkFormat{{Target: "/a"}}},
+		{" </a> ;\trt = x ,\r\n </b>;obs ", LinkFormat{
+			{Target: "/a", Attrs: []Attr{{Name: "rt", Value: "x"}}},
+			{Target: "/b", Attrs: []Attr{{Name: "obs", Flag: true}}},
+		}},
+		{`</a>;title="a, b; <c>"`, LinkFormat{
+			{Target: "/a", Attrs: []Attr{{Name: "title", Value: "a, b; <c>", Quoted: true}}},
+		}},
+		{`</a>;title="\"x\\y\z"`, LinkFormat{
+			{Target: "/a", Attrs: []Attr{{Name: "title", Value: `"x\yz`, Quoted: true}}},
+		}},
+		{`</a>;title=""`, LinkFormat{
+			{Target: "/a", Attrs: []Attr{{Name: "title", Quoted: true}}},
+		}},
+		{"</a>;sz=", LinkFormat{
+			{Target: "/a", Attrs: []Attr{{Name: "sz"}}},
+		}},
+	}
+	for _, tt := range tests {
+		lf, err := ParseString(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(lf, tt.want) {
+			t.Errorf("%q: parsed as %#v", tt.in, lf)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []string{
+		"/a",
+		"</a",
+		"</a></b>",
+		"</a>;",
+		"</a>;=x",
+		`</a>;title="open`,
+		`</a>;title="open\`,
+		"</a>;rt=x y",
+		"</a>;rt=\"x\"y",
+	}
+	for _, s := range tests {
+		if _, err := ParseString(s); !errors.Is(err, ErrSyntax) {
+			t.Errorf("%q: expected syntax error, got %v", s, err)
+		}
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	lf, err := ParseString(`</s>;rt="a b";rt=c;if=sensor;ct=0;ct=x;ct="40 50";sz=12;obs;title="T"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := lf[0]
+	if got := l.ResourceTypes(); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("rt %v", got)
+	}
+	if got := l.Interfaces(); !reflect.DeepEqual(got, []string{"sensor"}) {
+		t.Errorf("if %v", got)
+	}
+	if got := l.ContentFormats(); !reflect.DeepEqual(got, []int{0, 40, 50}) {
+		t.Errorf("ct %v", got)
+	}
+	if v, _ := l.Attr("rt"); v != "a b" {
+		t.Errorf("first rt %q", v)
+	}
+	if l.Size() != 12 || !l.Observable() || l.Title() != "T" {
+		t.Errorf("sz %d obs %v title %q", l.Size(), l.Observable(), l.Title())
+	}
+	if (Link{}).Size() != -1 || NewLink("/x").Add("sz", "big").Size() != -1 {
+		t.Error("missing or malformed sz")
+	}
+	if lf.Find("/s") == nil || lf.Find("/t") != nil {
+		t.Error("find")
+	}
+
+	built := NewLink("/b").Add("rt", "x y").AddQuoted("if", "z").AddFlag("obs").Add("title", "")
+	if got := built.String(); got != `</b>;rt="x y";if="z";obs;title=""` {
+		t.Errorf("built %s", got)
+	}
+}
+
+func TestFilterQuery(t *testing.T) {
+	lf, err := ParseString(`</sensors/temp>;rt="temperature-c core.s";obs,</sensors/light>;rt=light-lux;if=sensor,</act>;rt=switch`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"/sensors/temp", "/sensors/light", "/act"}},
+		{"rt=light-lux", []string{"/sensors/light"}},
+		{"rt=light", nil},
+		{"rt=light*", []string{"/sensors/light"}},
+		{"rt=core.s", []string{"/sensors/temp"}},
+		{"rt=*", []string{"/sensors/temp", "/sensors/light", "/act"}},
+		{"href=/sensors/*", []string{"/sensors/temp", "/sensors/light"}},
+		{"href=/act", []string{"/act"}},
+		{"obs", []string{"/sensors/temp"}},
+		{"obs=", []string{"/sensors/temp"}},
+		{"if=sensor", []string{"/sensors/light"}},
+		{"ct=0", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, l := range lf.FilterQuery(tt.query) {
+			got = append(got, l.Target)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: matched %v, expected %v", tt.query, got, tt.want)
+		}
+	}
+}
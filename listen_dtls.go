@@ -5,7 +5,7 @@
 package coap
 
 import (
-	"time"
+	"errors"
 
 	"github.com/qwerty-iot/dtls/v2"
 )
@@ -13,14 +13,22 @@ import (
 type DtlsListener struct {
 	name     string
 	socket   *dtls.Listener
-	handler  *Server
+	receive  TransportReceiveFunc
 	shutdown bool
 }
 
-func (l *DtlsListener) listen(name string, listener *dtls.Listener, handler *Server) error {
-	l.socket = listener
-	l.name = name
-	l.handler = handler
+// NewDtlsListener wraps a dtls.Listener, the listener starts reading once it
+// is passed to Server.AddTransport.
+func NewDtlsListener(name string, listener *dtls.Listener) *DtlsListener {
+	return &DtlsListener{name: name, socket: listener}
+}
+
+func (l *DtlsListener) Name() string {
+	return l.name
+}
+
+func (l *DtlsListener) Listen(receive TransportReceiveFunc) error {
+	l.receive = receive
 	go l.reader()
 	return nil
 }
@@ -36,35 +44,24 @@ func (l *DtlsListener) reader() {
 	//launch new reader
 	go l.reader()
 
-	var req Message
-	if err := req.unmarshalBinary(rawReq); err != nil {
-		logError(nil, err, "coap: error parsing COAP header")
-		return
-	}
-	req.Meta.RemoteAddr = peer.RemoteAddr()
-	req.Meta.DtlsPeer = peer
-	req.Meta.ListenerName = l.name
-	req.Meta.ReceivedAt = time.Now().UTC()
-	req.Meta.Server = l.handler
-
-	rsp := l.handler.handleMessage(&req)
-
-	if rsp != nil {
-		rawRsp, err := rsp.marshalBinary()
-		if err != nil {
-			logError(nil, err, "coap: error marshaling COAP response")
-			return
-		}
-
-		if rawRsp != nil {
-			err := peer.Write(rawRsp)
-			if err != nil {
-				logWarn(nil, err, "coap: error writing coap response")
-			}
-		}
+	l.receive(rawReq, peer.RemoteAddr())
+}
+
+func (l *DtlsListener) WriteTo(addr string, data []byte) error {
+	peer := l.FindPeer(addr)
+	if peer == nil {
+		return errors.New("coap: dtls peer not found: " + addr)
 	}
+	return peer.Write(data)
+}
 
-	return
+// HasEndpoint reports whether a DTLS session with addr exists.
+func (l *DtlsListener) HasEndpoint(addr string) bool {
+	return l.FindPeer(addr) != nil
+}
+
+func (l *DtlsListener) LocalAddr() string {
+	return l.socket.LocalAddr()
 }
 
 func (l *DtlsListener) FindPeer(addr string) *dtls.Peer {
@@ -83,8 +80,7 @@ func (l *DtlsListener) ClosePeer(addr string) {
 	return
 }
 
-func (l *DtlsListener) Close() {
+func (l *DtlsListener) Close() error {
 	l.shutdown = true
-	_ = l.socket.Shutdown()
-
+	return l.socket.Shutdown()
 }
@@ -6,11 +6,58 @@ package coap
 
 import (
 	"errors"
+	"strings"
 	"time"
 )
 
 type ProxyFunction func(rawReq []byte, to string) error
 
+// proxyTransport delivers messages for addresses of the form "prefix:to" to
+// the ProxyFunction registered for prefix in Config.ProxyCallbacks, there is
+// one for every prefix.
+type proxyTransport struct {
+	server   *Server
+	prefix   string
+	callback ProxyFunction
+}
+
+func (p *proxyTransport) Name() string {
+	return p.prefix
+}
+
+func (p *proxyTransport) Listen(receive TransportReceiveFunc) error {
+	// inbound messages are passed to Server.ProxySend
+	return nil
+}
+
+func (p *proxyTransport) WriteTo(addr string, data []byte) error {
+	if !p.HasEndpoint(addr) {
+		return errors.New("coap: address not for proxy " + p.prefix + ": " + addr)
+	}
+	sniffActivity(p.prefix, SniffWrite, p.LocalAddr(), addr, data)
+	return p.callback(data, addr[len(p.prefix)+1:])
+}
+
+func (p *proxyTransport) HasEndpoint(addr string) bool {
+	return strings.HasPrefix(addr, p.prefix+":")
+}
+
+func (p *proxyTransport) LocalAddr() string {
+	return p.server.proxyLocalAddr()
+}
+
+func (p *proxyTransport) Close() error {
+	return nil
+}
+
+// proxyLocalAddr is the local address reported for proxied messages.
+func (s *Server) proxyLocalAddr() string {
+	if s.udpListener != nil {
+		return s.udpListener.LocalAddr()
+	}
+	return ""
+}
+
 func (s *Server) ProxySend(prefix string, rawReq []byte, from string) ([]byte, error) {
 
 	var req Message
@@ -19,10 +66,15 @@ func (s *Server) ProxySend(prefix string, rawReq []byte, from string) ([]byte, e
 		return nil, err
 	}
 	req.Meta.RemoteAddr = prefix + ":" + from
+	if rsp := s.rejectToken(&req); rsp != nil {
+		return rsp.marshalBinary()
+	} else if len(req.Token) > s.config.MaxTokenLength {
+		return nil, ErrInvalidTokenLen
+	}
 	req.Meta.ListenerName = prefix
 	req.Meta.ReceivedAt = time.Now().UTC()
 	req.Meta.Server = s
-	sniffActivity("udp", SniffRead, req.Meta.RemoteAddr, s.udpListener.socket.LocalAddr().String(), rawReq)
+	sniffActivity(prefix, SniffRead, req.Meta.RemoteAddr, s.proxyLocalAddr(), rawReq)
 
 	rsp := s.handleMessage(&req)
 
@@ -40,12 +92,3 @@ func (s *Server) ProxySend(prefix string, rawReq []byte, from string) ([]byte, e
 
 	return nil, nil
 }
-
-func proxyRecv(s *Server, prefix string, addr string, data []byte) error {
-	sniffActivity("udp", SniffWrite, s.udpListener.socket.LocalAddr().String(), addr, data)
-	cb, found := s.config.ProxyCallbacks[prefix]
-	if !found {
-		return errors.New("callback not found for prefix: " + prefix)
-	}
-	return cb(data, addr[len(prefix)+1:])
-}
@@ -0,0 +1,86 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyTransport(t *testing.T) {
+	type sniffed struct {
+		transport string
+		op        string
+	}
+	sniffs := make(chan sniffed, 4)
+	prev := sniffActivityCallback
+	sniffActivityCallback = func(transportType string, op string, from string, to string, data []byte) {
+		if transportType != "udp" {
+			sniffs <- sniffed{transportType, op}
+		}
+	}
+	defer func() { sniffActivityCallback = prev }()
+
+	sent := make(chan string, 1)
+	conf := &Config{}
+	conf.AddProxyReceiver("lora", func(rawReq []byte, to string) error {
+		sent <- to
+		return nil
+	})
+	s := newTestServer(t, conf)
+	s.AddRoute("hello", func(req *Message) *Message {
+		return req.MakeReply(RspCodeContent, []byte("hi"))
+	})
+
+	data, _ := newTestRequest(TypeConfirmable, CodeGet, "hello").WithToken([]byte{1}).marshalBinary()
+	raw, err := s.ProxySend("lora", data, "dev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp, err := parseMessage(raw); err != nil || string(rsp.Payload) != "hi" {
+		t.Fatalf("proxied request answered with %v, %v", rsp, err)
+	}
+
+	if _, err := s.Send("lora:dev2", newTestRequest(TypeNonConfirmable, CodeGet, "x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if to := <-sent; to != "dev2" {
+		t.Errorf("sent to %s", to)
+	}
+
+	got := map[sniffed]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case sn := <-sniffs:
+			got[sn] = true
+		case <-time.After(time.Second):
+			t.Fatalf("sniffed %v", got)
+		}
+	}
+	if !got[sniffed{"lora", SniffRead}] || !got[sniffed{"lora", SniffWrite}] {
+		t.Errorf("sniffed %v", got)
+	}
+}
+
+func TestProxyTransportName(t *testing.T) {
+	for _, prefix := range []string{"udp", "lora"} {
+		conf := &Config{}
+		conf.AddProxyReceiver(prefix, func(rawReq []byte, to string) error {
+			return nil
+		})
+		s, err := NewServer(conf, "127.0.0.1:0", nil)
+		if prefix == "udp" {
+			if err == nil {
+				s.Close()
+				t.Errorf("proxy %s shadows the udp transport", prefix)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+}
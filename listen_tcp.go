@@ -0,0 +1,440 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TcpListener carries CoAP over TCP, TLS or WebSockets using the RFC 8323
+// framing. A TcpListener without a socket only holds connections dialed by
+// the Server.
+type TcpListener struct {
+	name     string
+	socket   net.Listener
+	handler  *Server
+	conns    sync.Map
+	shutdown bool
+}
+
+type tcpConn struct {
+	listener *TcpListener
+	conn     net.Conn
+	ws       *websocket.Conn
+	addr     string
+	writeMux sync.Mutex
+	// the capabilities from the CSM of the peer, set by the reader
+	csmMux         sync.RWMutex
+	maxMessageSize int
+	maxTokenLength int
+}
+
+// tcpDefaultMaxMessageSize is the Max-Message-Size assumed for a peer until
+// its CSM arrives (RFC 8323 section 5.3.1).
+const tcpDefaultMaxMessageSize = 1152
+
+func (l *TcpListener) listen(name string, addr string, config *tls.Config, handler *Server) error {
+	var listener net.Listener
+	var err error
+	if config != nil {
+		listener, err = tls.Listen("tcp", addr, config)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.socket = listener
+	l.name = name
+	l.handler = handler
+	go l.acceptor()
+	return nil
+}
+
+func (l *TcpListener) acceptor() {
+	for {
+		conn, err := l.socket.Accept()
+		if err != nil {
+			if l.shutdown {
+				logDebug(nil, nil, "coap: acceptor shutdown")
+				return
+			}
+			logWarn(nil, err, "coap: error accepting COAP connection")
+			time.Sleep(time.Millisecond * 100)
+			continue
+		}
+		go l.reader(l.register(&tcpConn{conn: conn}))
+	}
+}
+
+func (l *TcpListener) dial(addr string, config *tls.Config) (string, error) {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return "", err
+	}
+	c := l.register(&tcpConn{conn: conn})
+	go l.reader(c)
+	return c.addr, nil
+}
+
+func (l *TcpListener) register(c *tcpConn) *tcpConn {
+	c.listener = l
+	c.addr = c.remoteAddr()
+	c.maxMessageSize = tcpDefaultMaxMessageSize
+	c.maxTokenLength = DefaultMaxTokenLength
+	l.conns.Store(c.addr, c)
+
+	// both sides must open with a CSM (RFC 8323 section 5.3)
+	csm := &Message{Code: SignalCodeCSM}
+	csm.WithOption(OptSignalMaxMessageSize, l.handler.config.MaxStreamMessageSize, true)
+	csm.WithOption(OptSignalBlockWiseTransfer, []byte{}, true)
+	if l.handler.config.MaxTokenLength > DefaultMaxTokenLength {
+		csm.WithOption(OptSignalExtendedTokenLength, uint32(l.handler.config.MaxTokenLength), true)
+	}
+	if err := c.write(csm); err != nil {
+		logWarn(nil, err, "coap: error writing CSM")
+	}
+	return c
+}
+
+func (l *TcpListener) reader(c *tcpConn) {
+	defer l.remove(c)
+
+	var r *bufio.Reader
+	if c.ws != nil {
+		// the WebSocket frame already carries the length, allow for the header
+		// and token
+		c.ws.SetReadLimit(int64(l.handler.config.MaxStreamMessageSize + l.handler.config.MaxTokenLength + 8))
+	} else {
+		r = bufio.NewReader(c.conn)
+	}
+	for {
+		frame, err := c.read(r)
+		if err != nil {
+			if errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrInvalidTokenLen) {
+				c.abort(err.Error())
+			} else if !l.shutdown && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logWarn(nil, err, "coap: error reading COAP frame")
+			}
+			return
+		}
+		sniffActivity(l.name, SniffRead, c.addr, c.localAddr(), frame)
+
+		var req Message
+		if err := req.unmarshalStream(frame); err != nil {
+			logError(nil, err, "coap: error parsing COAP header")
+			c.abort("malformed message")
+			return
+		}
+		if len(req.Token) > l.handler.config.MaxTokenLength {
+			c.abort(ErrInvalidTokenLen.Error())
+			return
+		}
+		req.Meta.RemoteAddr = c.addr
+		req.Meta.ListenerName = l.name
+		req.Meta.ReceivedAt = time.Now().UTC()
+		req.Meta.Server = l.handler
+		req.Meta.Reliable = true
+		req.Meta.MaxMessageSize, _ = c.limits()
+
+		if req.Code.IsSignaling() {
+			if !l.signal(c, &req) {
+				return
+			}
+			continue
+		}
+		if req.Code == CodeEmpty {
+			// empty messages must be ignored (RFC 8323 section 3.4)
+			continue
+		}
+		go l.handle(c, &req)
+	}
+}
+
+func (l *TcpListener) signal(c *tcpConn, req *Message) bool {
+	switch req.Code {
+	case SignalCodeCSM:
+		c.csmMux.Lock()
+		if mms := req.Option(OptSignalMaxMessageSize); mms != nil {
+			c.maxMessageSize = int(mms.(uint32))
+		}
+		if etl := req.Option(OptSignalExtendedTokenLength); etl != nil {
+			// values outside the range of RFC 8974 section 2.2.2 are not
+			// trusted to size tokens
+			c.maxTokenLength = int(etl.(uint32))
+			if c.maxTokenLength < DefaultMaxTokenLength {
+				c.maxTokenLength = DefaultMaxTokenLength
+			} else if c.maxTokenLength > ExtendedMaxTokenLength {
+				c.maxTokenLength = ExtendedMaxTokenLength
+			}
+		}
+		logDebug(req, nil, "received CSM (max message size:%d max token length:%d blockwise:%t)", c.maxMessageSize, c.maxTokenLength, req.Option(OptSignalBlockWiseTransfer) != nil)
+		c.csmMux.Unlock()
+	case SignalCodePing:
+		if callback := l.handler.getSpecialRoute("~keepalive"); callback != nil {
+			callRoute(callback, req)
+		}
+		pong := &Message{Code: SignalCodePong, Token: req.Token}
+		if req.Option(OptSignalCustody) != nil {
+			pong.WithOption(OptSignalCustody, []byte{}, true)
+		}
+		if err := c.write(pong); err != nil {
+			logWarn(req, err, "coap: error writing pong")
+		}
+	case SignalCodePong:
+		l.handler.handleAcknowledgement(req)
+	case SignalCodeRelease:
+		logDebug(req, nil, "connection released by peer")
+		return false
+	case SignalCodeAbort:
+		logWarn(req, nil, "connection aborted by peer: %s", string(req.Payload))
+		return false
+	default:
+		logDebug(req, nil, "ignoring unknown signaling code %s", req.Code.NumberString())
+	}
+	return true
+}
+
+func (l *TcpListener) handle(c *tcpConn, req *Message) {
+	// stream transports are reliable, requests and responses map onto the
+	// confirmable exchange and its piggybacked acknowledgement
+	if req.IsRequest() {
+		req.Type = TypeConfirmable
+	} else {
+		req.Type = TypeAcknowledgement
+	}
+
+	rsp := l.handler.handleMessage(req)
+
+	// there are no resets or empty acknowledgements on stream transports
+	if rsp != nil && rsp.Type != TypeReset && rsp.Code != CodeEmpty {
+		err := c.write(rsp)
+		var pe *PanicError
+		if errors.As(err, &pe) && req.IsRequest() {
+			logPanic(rsp, pe)
+			err = c.write(internalError(req))
+		}
+		if err != nil {
+			logWarn(nil, err, "coap: error writing coap response")
+		}
+	}
+}
+
+func (l *TcpListener) remove(c *tcpConn) {
+	l.conns.CompareAndDelete(c.addr, c)
+	c.close()
+}
+
+func (c *tcpConn) read(r *bufio.Reader) ([]byte, error) {
+	if c.ws == nil {
+		return readStreamFrame(r, c.listener.handler.config.MaxStreamMessageSize, c.listener.handler.config.MaxTokenLength)
+	}
+	mt, frame, err := c.ws.ReadMessage()
+	if err != nil {
+		if errors.Is(err, websocket.ErrReadLimit) {
+			return nil, ErrMessageTooLarge
+		}
+		return nil, err
+	}
+	if mt != websocket.BinaryMessage {
+		return nil, errors.New("coap: unexpected websocket message type")
+	}
+	return frame, nil
+}
+
+// limits returns the Max-Message-Size and the longest token of the peer.
+func (c *tcpConn) limits() (int, int) {
+	c.csmMux.RLock()
+	defer c.csmMux.RUnlock()
+	return c.maxMessageSize, c.maxTokenLength
+}
+
+func (c *tcpConn) write(msg *Message) error {
+	maxMessageSize, maxTokenLength := c.limits()
+	if len(msg.Token) > maxTokenLength {
+		return fmt.Errorf("%w: %d bytes exceeds %d", ErrInvalidTokenLen, len(msg.Token), maxTokenLength)
+	}
+	var data []byte
+	var err error
+	if c.ws != nil {
+		data, err = msg.marshalWebsocket()
+	} else {
+		data, err = msg.marshalStream()
+	}
+	if err != nil {
+		return err
+	}
+	if !msg.Code.IsSignaling() && maxMessageSize > 0 && len(data) > maxMessageSize {
+		return ErrMessageTooLarge
+	}
+	sniffActivity(c.listener.name, SniffWrite, c.localAddr(), c.addr, data)
+	c.writeMux.Lock()
+	if c.ws != nil {
+		err = c.ws.WriteMessage(websocket.BinaryMessage, data)
+	} else {
+		_, err = c.conn.Write(data)
+	}
+	c.writeMux.Unlock()
+	return err
+}
+
+func (c *tcpConn) remoteAddr() string {
+	if c.ws != nil {
+		return c.ws.RemoteAddr().String()
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *tcpConn) localAddr() string {
+	if c.ws != nil {
+		return c.ws.LocalAddr().String()
+	}
+	return c.conn.LocalAddr().String()
+}
+
+func (c *tcpConn) close() {
+	if c.ws != nil {
+		_ = c.ws.Close()
+	} else {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *tcpConn) abort(diagnostic string) {
+	msg := &Message{Code: SignalCodeAbort, Payload: []byte(diagnostic)}
+	_ = c.write(msg)
+	c.close()
+}
+
+func (c *tcpConn) release() {
+	msg := &Message{Code: SignalCodeRelease}
+	_ = c.write(msg)
+	c.close()
+}
+
+func (l *TcpListener) findConn(addr string) *tcpConn {
+	if l == nil {
+		return nil
+	}
+	c, found := l.conns.Load(addr)
+	if !found {
+		return nil
+	}
+	return c.(*tcpConn)
+}
+
+func (l *TcpListener) ClosePeer(addr string) {
+	if c := l.findConn(addr); c != nil {
+		c.release()
+	}
+}
+
+func (l *TcpListener) Close() {
+	if l == nil {
+		return
+	}
+	l.shutdown = true
+	if l.socket != nil {
+		_ = l.socket.Close()
+	}
+	l.conns.Range(func(key, value interface{}) bool {
+		value.(*tcpConn).release()
+		return true
+	})
+}
+
+// ListenTcp accepts CoAP over TCP connections (RFC 8323) on addr.
+func (s *Server) ListenTcp(addr string) error {
+	return s.listenStream(&s.tcpListener, "tcp", addr, nil)
+}
+
+// ListenTls accepts CoAP over TLS connections (RFC 8323) on addr.
+func (s *Server) ListenTls(addr string, config *tls.Config) error {
+	if config == nil {
+		return errors.New("coap: tls config required")
+	}
+	return s.listenStream(&s.tlsListener, "tls", addr, config)
+}
+
+// DialTcp opens a CoAP over TCP connection to addr, the returned address is
+// the one to pass to Send for messages on that connection.
+func (s *Server) DialTcp(addr string) (string, error) {
+	return s.streamListener(&s.tcpListener, "tcp").dial(addr, nil)
+}
+
+// DialTls opens a CoAP over TLS connection to addr, the returned address is
+// the one to pass to Send for messages on that connection.
+func (s *Server) DialTls(addr string, config *tls.Config) (string, error) {
+	if config == nil {
+		return "", errors.New("coap: tls config required")
+	}
+	return s.streamListener(&s.tlsListener, "tls").dial(addr, config)
+}
+
+// Ping sends a 7.02 Ping over the stream connection to addr and waits for
+// the matching Pong.
+func (s *Server) Ping(addr string, timeout time.Duration) error {
+	c := s.findStreamConn(addr)
+	if c == nil {
+		return errors.New("coap: no stream connection to " + addr)
+	}
+	msg := &Message{Code: SignalCodePing}
+	msg.Meta.RemoteAddr = addr
+	pendingChan := s.pendingSave(msg)
+	if err := c.write(msg); err != nil {
+		s.pendingDelete(msg)
+		return err
+	}
+	select {
+	case <-pendingChan:
+		return nil
+	case <-time.After(timeout):
+		s.pendingDelete(msg)
+		return ErrTimeout
+	}
+}
+
+func (s *Server) listenStream(pl **TcpListener, name string, addr string, config *tls.Config) error {
+	l := s.streamListener(pl, name)
+	if l.socket != nil {
+		return errors.New("coap: already listening on " + name)
+	}
+	return l.listen(name, addr, config, s)
+}
+
+func (s *Server) streamListener(l **TcpListener, name string) *TcpListener {
+	s.streamMux.Lock()
+	defer s.streamMux.Unlock()
+	if *l == nil {
+		*l = &TcpListener{name: name, handler: s}
+	}
+	return *l
+}
+
+func (s *Server) findStreamConn(addr string) *tcpConn {
+	if c := s.tcpListener.findConn(addr); c != nil {
+		return c
+	}
+	if c := s.tlsListener.findConn(addr); c != nil {
+		return c
+	}
+	return s.wsListener.findConn(addr)
+}
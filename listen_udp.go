@@ -7,30 +7,43 @@ package coap
 import (
 	"errors"
 	"net"
-	"time"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type UdpListener struct {
 	name     string
 	socket   *net.UDPConn
-	handler  *Server
+	receive  TransportReceiveFunc
 	shutdown bool
-}
 
-func (l *UdpListener) listen(name string, addr string, handler *Server) error {
+	// multicast groups joined on the socket by their address
+	groups    map[string]*MulticastListener
+	groupsMux sync.RWMutex
+}
 
+// NewUdpListener binds a UDP socket on addr, the listener starts reading once
+// it is passed to Server.AddTransport.
+func NewUdpListener(name string, addr string) (*UdpListener, error) {
 	uaddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	listener, err := net.ListenUDP("udp", uaddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &UdpListener{name: name, socket: listener}, nil
+}
+
+func (l *UdpListener) Name() string {
+	return l.name
+}
 
-	l.socket = listener
-	l.name = name
-	l.handler = handler
+func (l *UdpListener) Listen(receive TransportReceiveFunc) error {
+	l.receive = receive
 	go l.reader()
 	return nil
 }
@@ -38,9 +51,10 @@ func (l *UdpListener) listen(name string, addr string, handler *Server) error {
 func (l *UdpListener) reader() {
 
 	var rawReq = make([]byte, 8192)
+	var oob = make([]byte, 512)
 
 	for {
-		rawLen, from, err := l.socket.ReadFromUDP(rawReq)
+		rawLen, oobLen, _, from, err := l.socket.ReadMsgUDP(rawReq, oob)
 		if err != nil {
 			if l.shutdown {
 				logDebug(nil, nil, "coap: reader shutdown")
@@ -52,44 +66,80 @@ func (l *UdpListener) reader() {
 		}
 		newReq := append([]byte(nil), rawReq[:rawLen]...)
 		sniffActivity("udp", SniffRead, from.String(), l.socket.LocalAddr().String(), newReq)
-		go l.handle(newReq, from)
+		receive := l.receive
+		if ml := l.groupFor(oob[:oobLen]); ml != nil {
+			receive = ml.receive
+		}
+		go receive(newReq, from.String())
 	}
 }
 
-func (l *UdpListener) handle(rawReq []byte, from *net.UDPAddr) {
-
-	var req Message
-	if err := req.unmarshalBinary(rawReq); err != nil {
-		logError(nil, err, "coap: error parsing COAP header")
-		return
-	}
-	req.Meta.RemoteAddr = from.String()
-	req.Meta.ListenerName = l.name
-	req.Meta.ReceivedAt = time.Now().UTC()
-	req.Meta.Server = l.handler
-
-	rsp := l.handler.handleMessage(&req)
-
-	if rsp != nil {
-		rawRsp, err := rsp.marshalBinary()
-		if err != nil {
-			logError(nil, err, "coap: error marshaling COAP response")
-			return
+// joinGroup joins the group of ml on the socket, the datagrams sent to the
+// group are handed to ml.
+func (l *UdpListener) joinGroup(ml *MulticastListener) error {
+	group := &net.UDPAddr{IP: ml.group.IP}
+	if ml.group.IP.To4() != nil {
+		p := ipv4.NewPacketConn(l.socket)
+		if err := p.JoinGroup(ml.ifi, group); err != nil {
+			return err
 		}
-
-		if rawRsp != nil {
-			sniffActivity("udp", SniffWrite, l.socket.LocalAddr().String(), from.String(), rawRsp)
-			_, err = l.socket.WriteToUDP(rawRsp, from)
-			if err != nil {
-				logWarn(nil, err, "coap: error writing coap response")
-			}
+		if err := p.SetControlMessage(ipv4.FlagDst, true); err != nil {
+			_ = p.LeaveGroup(ml.ifi, group)
+			return err
 		}
+	} else {
+		p := ipv6.NewPacketConn(l.socket)
+		if err := p.JoinGroup(ml.ifi, group); err != nil {
+			return err
+		}
+		if err := p.SetControlMessage(ipv6.FlagDst, true); err != nil {
+			_ = p.LeaveGroup(ml.ifi, group)
+			return err
+		}
+	}
+	l.groupsMux.Lock()
+	if l.groups == nil {
+		l.groups = map[string]*MulticastListener{}
 	}
+	l.groups[ml.group.IP.String()] = ml
+	l.groupsMux.Unlock()
+	return nil
+}
 
-	return
+func (l *UdpListener) leaveGroup(ml *MulticastListener) error {
+	l.groupsMux.Lock()
+	delete(l.groups, ml.group.IP.String())
+	l.groupsMux.Unlock()
+	group := &net.UDPAddr{IP: ml.group.IP}
+	if ml.group.IP.To4() != nil {
+		return ipv4.NewPacketConn(l.socket).LeaveGroup(ml.ifi, group)
+	}
+	return ipv6.NewPacketConn(l.socket).LeaveGroup(ml.ifi, group)
 }
 
-func (l *UdpListener) Send(addr string, data []byte) error {
+// groupFor returns the listener of the multicast group a datagram was sent
+// to, from its control messages.
+func (l *UdpListener) groupFor(oob []byte) *MulticastListener {
+	if len(oob) == 0 {
+		return nil
+	}
+	var dst net.IP
+	cm4 := &ipv4.ControlMessage{}
+	cm6 := &ipv6.ControlMessage{}
+	if cm4.Parse(oob) == nil && cm4.Dst != nil {
+		dst = cm4.Dst
+	} else if cm6.Parse(oob) == nil && cm6.Dst != nil {
+		dst = cm6.Dst
+	}
+	if !dst.IsMulticast() {
+		return nil
+	}
+	l.groupsMux.RLock()
+	defer l.groupsMux.RUnlock()
+	return l.groups[dst.String()]
+}
+
+func (l *UdpListener) WriteTo(addr string, data []byte) error {
 	if l.shutdown {
 		return errors.New("coap: port is shutdown")
 	}
@@ -105,7 +155,18 @@ func (l *UdpListener) Send(addr string, data []byte) error {
 	return nil
 }
 
-func (l *UdpListener) Close() {
+// Send writes data to addr.
+//
+// Deprecated: use WriteTo.
+func (l *UdpListener) Send(addr string, data []byte) error {
+	return l.WriteTo(addr, data)
+}
+
+func (l *UdpListener) LocalAddr() string {
+	return l.socket.LocalAddr().String()
+}
+
+func (l *UdpListener) Close() error {
 	l.shutdown = true
-	_ = l.socket.Close()
+	return l.socket.Close()
 }
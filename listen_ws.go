@@ -0,0 +1,102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketPath is the well-known path of the CoAP over WebSockets endpoint
+// (RFC 8323 section 4.4).
+const WebsocketPath = "/.well-known/coap"
+
+const websocketProtocol = "coap"
+
+// WebsocketHandler returns an http.Handler that accepts CoAP over WebSockets
+// connections (RFC 8323 section 4), for mounting on an existing http server at
+// WebsocketPath.
+func (s *Server) WebsocketHandler() http.Handler {
+	l := s.streamListener(&s.wsListener, "ws")
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{websocketProtocol},
+		CheckOrigin:  s.config.WebsocketCheckOrigin,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasWebsocketProtocol(r) {
+			http.Error(w, "coap: websocket subprotocol coap required", http.StatusBadRequest)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logWarn(nil, err, "coap: error upgrading websocket")
+			return
+		}
+		l.reader(l.register(&tcpConn{ws: ws}))
+	})
+}
+
+// ListenWebsocket serves CoAP over WebSockets on addr at WebsocketPath.
+func (s *Server) ListenWebsocket(addr string) error {
+	l := s.streamListener(&s.wsListener, "ws")
+	if l.socket != nil {
+		return errors.New("coap: already listening on ws")
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l.socket = listener
+
+	mux := http.NewServeMux()
+	mux.Handle(WebsocketPath, s.WebsocketHandler())
+	go func() {
+		err := http.Serve(listener, mux)
+		if !l.shutdown {
+			logWarn(nil, err, "coap: websocket listener stopped")
+		}
+	}()
+	return nil
+}
+
+// DialWebsocket opens a CoAP over WebSockets connection to a ws://, wss://,
+// coap+ws:// or coap+wss:// url, the returned address is the one to pass to
+// Send for messages on that connection.
+func (s *Server) DialWebsocket(url string, header http.Header) (string, error) {
+	if strings.HasPrefix(url, "coap+") {
+		url = url[len("coap+"):]
+	}
+	if strings.Count(url, "/") == 2 {
+		url += WebsocketPath
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{websocketProtocol}}
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		return "", err
+	}
+	if ws.Subprotocol() != websocketProtocol {
+		_ = ws.Close()
+		return "", errors.New("coap: websocket subprotocol coap not accepted")
+	}
+
+	l := s.streamListener(&s.wsListener, "ws")
+	c := l.register(&tcpConn{ws: ws})
+	go l.reader(c)
+	return c.addr, nil
+}
+
+func hasWebsocketProtocol(r *http.Request) bool {
+	for _, p := range websocket.Subprotocols(r) {
+		if p == websocketProtocol {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebsocketRoundTrip(t *testing.T) {
+	srv, err := NewServer(nil, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.AddRoute("hello", func(req *Message) *Message {
+		if !req.Meta.Reliable {
+			t.Error("websocket request not marked reliable")
+		}
+		return req.MakeReply(RspCodeContent, append([]byte("hi "), req.Payload...))
+	})
+	mux := http.NewServeMux()
+	mux.Handle(WebsocketPath, srv.WebsocketHandler())
+	hs := httptest.NewServer(mux)
+	defer hs.Close()
+
+	client, err := NewServer(nil, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	addr, err := client.DialWebsocket("coap+ws://"+strings.TrimPrefix(hs.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := NewMessage()
+	req.Type = TypeConfirmable
+	req.Code = CodePost
+	req.WithPathString("hello")
+	req.Payload = []byte("ws")
+	rsp, err := client.Send(addr, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != RspCodeContent || string(rsp.Payload) != "hi ws" {
+		t.Fatalf("unexpected response: %v %q", rsp.Code, rsp.Payload)
+	}
+}
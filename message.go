@@ -5,11 +5,14 @@
 package coap
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"time"
 
+	"github.com/qwerty-iot/coap/linkformat"
 	"github.com/qwerty-iot/dtls/v2"
 
 	"github.com/qwerty-iot/tox"
@@ -23,6 +26,9 @@ type Metadata struct {
 	BlockSize      int
 	MaxMessageSize int
 	Server         *Server
+	Reliable       bool
+	// Multicast is set on requests received from a multicast group.
+	Multicast bool
 }
 
 // Message is a CoAP message.
@@ -42,6 +48,30 @@ type Message struct {
 	PathVars  map[string]string
 
 	Meta Metadata
+
+	ctx context.Context
+
+	// set by WithURI
+	uriScheme string
+	uriAddr   string
+
+	deferred *ResponseWriter
+
+	// set on requests received with OSCORE
+	oscore *oscoreRequest
+	// set on requests sent with OSCORE, their notifications are verified
+	// with it
+	oscoreSent *oscoreRequest
+}
+
+// Context returns the context of a received request, it is cancelled when the
+// Server shuts down. Messages that were not received return
+// context.Background().
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
 }
 
 func NewMessage() *Message {
@@ -65,7 +95,22 @@ func (m *Message) GetBlock2() *BlockMetadata {
 }
 
 func (m *Message) getBlockKey() string {
-	return m.Meta.RemoteAddr + m.Code.String() + m.PathString() + m.QueryString()
+	if m.oscore != nil {
+		// the remaining blocks are requested without the protected path
+		return m.oscore.blockKey
+	}
+	key := m.Meta.RemoteAddr + m.Code.String() + m.PathString() + m.QueryString()
+	// concurrent transfers to the same resource differ in their Request-Tag
+	// (RFC 9175 section 3.3)
+	for _, tag := range m.Options(OptRequestTag) {
+		key += fmt.Sprintf("#%x", tag)
+	}
+	if v, ok := m.Option(OptOscore).([]byte); ok {
+		// the path of a protected request is encrypted, its kid and partial
+		// IV tell the transfers apart
+		key += fmt.Sprintf("#%x", v)
+	}
+	return key
 }
 
 func (m *Message) RequiresBlockwise() bool {
@@ -92,6 +137,11 @@ func (m *Message) IsRequest() bool {
 	return m.Code < 10
 }
 
+// IsSuccess returns true if this message is a 2.xx response.
+func (m *Message) IsSuccess() bool {
+	return m.Code>>5 == 2
+}
+
 func (m *Message) PacketSize() int {
 	if m.packetSize != 0 {
 		return m.packetSize
@@ -103,7 +153,7 @@ func (m *Message) PacketSize() int {
 func (m *Message) OptionsMap() map[string]interface{} {
 	ret := map[string]interface{}{}
 	for _, v := range m.opts {
-		def := optionDefs[v.ID]
+		def := optionDefFor(m.Code, v.ID)
 		if ro, found := ret[def.name]; found {
 			if ra, oka := ro.([]interface{}); oka {
 				ra = append(ra, v.Value)
@@ -312,6 +362,21 @@ func (m *Message) WithContentFormat(mt MediaType) *Message {
 	return m
 }
 
+// LinkFormat parses the payload as application/link-format (RFC 6690).
+func (m *Message) LinkFormat() (linkformat.LinkFormat, error) {
+	if cf := m.ContentFormat(); cf != AppLinkFormat && cf != None {
+		return nil, errors.New("coap: payload is not link-format: " + cf.String())
+	}
+	return linkformat.Parse(m.Payload)
+}
+
+// WithLinkFormat sets the payload to the links in link-format.
+func (m *Message) WithLinkFormat(lf linkformat.LinkFormat) *Message {
+	m.Payload = linkformat.Marshal(lf)
+	m.WithContentFormat(AppLinkFormat)
+	return m
+}
+
 func (m *Message) WithType(ty COAPType) *Message {
 	m.Type = ty
 	return m
@@ -10,7 +10,7 @@ import (
 )
 
 // OptionID identifies an option in a message.
-type OptionID uint8
+type OptionID uint16
 
 /*
    +-----+----+---+---+---+----------------+--------+--------+---------+
@@ -36,6 +36,9 @@ type OptionID uint8
    |  35 | x  | x | - |   | Proxy-Uri      | string | 1-1034 | (none)  |
    |  39 | x  | x | - |   | Proxy-Scheme   | string | 1-255  | (none)  |
    |  60 |    |   | x |   | Size1          | uint   | 0-4    | (none)  |
+   | 252 |    |   |   |   | Echo           | opaque | 1-40   | (none)  |
+   | 258 |    | x | - |   | No-Response    | uint   | 0-1    | 0       |
+   | 292 |    |   |   | x | Request-Tag    | opaque | 0-8    | (none)  |
    +-----+----+---+---+---+----------------+--------+--------+---------+
 */
 
@@ -48,6 +51,7 @@ const (
 	OptObserve       OptionID = 6
 	OptURIPort       OptionID = 7
 	OptLocationPath  OptionID = 8
+	OptOscore        OptionID = 9
 	OptURIPath       OptionID = 11
 	OptContentFormat OptionID = 12
 	OptMaxAge        OptionID = 14
@@ -60,6 +64,23 @@ const (
 	OptProxyURI      OptionID = 35
 	OptProxyScheme   OptionID = 39
 	OptSize1         OptionID = 60
+	OptEcho          OptionID = 252
+	OptNoResponse    OptionID = 258
+	OptRequestTag    OptionID = 292
+)
+
+// Signaling option IDs (RFC 8323 section 5), their meaning depends on the
+// signaling code of the message that carries them.
+const (
+	OptSignalMaxMessageSize    OptionID = 2
+	OptSignalBlockWiseTransfer OptionID = 4
+	// OptSignalExtendedTokenLength is the longest token a peer accepts (RFC
+	// 8974 section 2.2.2).
+	OptSignalExtendedTokenLength OptionID = 6
+	OptSignalCustody             OptionID = 2
+	OptSignalAlternativeAddr     OptionID = 2
+	OptSignalHoldOff             OptionID = 4
+	OptSignalBadCSMOption        OptionID = 2
 )
 
 // Option value format (RFC7252 section 3.2)
@@ -80,7 +101,7 @@ type optionDef struct {
 	maxLen      int
 }
 
-var optionDefs = [256]optionDef{
+var optionDefs = map[OptionID]optionDef{
 	OptIfMatch:       {name: "if-match", valueFormat: valueOpaque, minLen: 0, maxLen: 8},
 	OptURIHost:       {name: "uri-host", valueFormat: valueString, minLen: 1, maxLen: 255},
 	OptETag:          {name: "etag", valueFormat: valueOpaque, minLen: 1, maxLen: 8},
@@ -88,6 +109,7 @@ var optionDefs = [256]optionDef{
 	OptObserve:       {name: "observe", valueFormat: valueUint, minLen: 0, maxLen: 3},
 	OptURIPort:       {name: "uri-port", valueFormat: valueUint, minLen: 0, maxLen: 2},
 	OptLocationPath:  {name: "location-path", valueFormat: valueString, minLen: 0, maxLen: 255},
+	OptOscore:        {name: "oscore", valueFormat: valueOpaque, minLen: 0, maxLen: 255},
 	OptURIPath:       {name: "uri-path", valueFormat: valueString, minLen: 0, maxLen: 255},
 	OptContentFormat: {name: "content-format", valueFormat: valueUint, minLen: 0, maxLen: 2},
 	OptMaxAge:        {name: "max-age", valueFormat: valueUint, minLen: 0, maxLen: 4},
@@ -100,6 +122,39 @@ var optionDefs = [256]optionDef{
 	OptSize2:         {name: "size2", valueFormat: valueUint, minLen: 0, maxLen: 4},
 	OptBlock1:        {name: "block1", valueFormat: valueOpaque, minLen: 0, maxLen: 3},
 	OptBlock2:        {name: "block2", valueFormat: valueOpaque, minLen: 0, maxLen: 3},
+	OptEcho:          {name: "echo", valueFormat: valueOpaque, minLen: 1, maxLen: 40},
+	OptNoResponse:    {name: "no-response", valueFormat: valueUint, minLen: 0, maxLen: 1},
+	OptRequestTag:    {name: "request-tag", valueFormat: valueOpaque, minLen: 0, maxLen: 8},
+}
+
+var signalOptionDefs = map[COAPCode]map[OptionID]optionDef{
+	SignalCodeCSM: {
+		OptSignalMaxMessageSize:      {name: "max-message-size", valueFormat: valueUint, minLen: 0, maxLen: 4},
+		OptSignalBlockWiseTransfer:   {name: "block-wise-transfer", valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+		OptSignalExtendedTokenLength: {name: "extended-token-length", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	},
+	SignalCodePing: {
+		OptSignalCustody: {name: "custody", valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	SignalCodePong: {
+		OptSignalCustody: {name: "custody", valueFormat: valueEmpty, minLen: 0, maxLen: 0},
+	},
+	SignalCodeRelease: {
+		OptSignalAlternativeAddr: {name: "alternative-address", valueFormat: valueString, minLen: 1, maxLen: 255},
+		OptSignalHoldOff:         {name: "hold-off", valueFormat: valueUint, minLen: 0, maxLen: 3},
+	},
+	SignalCodeAbort: {
+		OptSignalBadCSMOption: {name: "bad-csm-option", valueFormat: valueUint, minLen: 0, maxLen: 2},
+	},
+}
+
+// optionDefFor returns the definition of an option, taking into account that
+// signaling messages reuse option numbers with a different meaning.
+func optionDefFor(code COAPCode, optionID OptionID) optionDef {
+	if code.IsSignaling() {
+		return signalOptionDefs[code][optionID]
+	}
+	return optionDefs[optionID]
 }
 
 type option struct {
@@ -162,8 +217,8 @@ func (o option) toBytes() []byte {
 	return encodeInt(v)
 }
 
-func parseOptionValue(optionID OptionID, valueBuf []byte) interface{} {
-	def := optionDefs[optionID]
+func parseOptionValue(code COAPCode, optionID OptionID, valueBuf []byte) interface{} {
+	def := optionDefFor(code, optionID)
 	if def.valueFormat == valueUnknown {
 		// Skip unrecognized options (RFC7252 section 5.4.1)
 		return nil
@@ -175,7 +230,7 @@ func parseOptionValue(optionID OptionID, valueBuf []byte) interface{} {
 	switch def.valueFormat {
 	case valueUint:
 		intValue := decodeInt(valueBuf)
-		if optionID == OptContentFormat || optionID == OptAccept {
+		if !code.IsSignaling() && (optionID == OptContentFormat || optionID == OptAccept) {
 			return MediaType(intValue)
 		} else {
 			return intValue
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"sort"
 )
 
@@ -19,6 +20,64 @@ const (
 	extoptError      = 15
 )
 
+// Token lengths above 12 are extended like option lengths (RFC 8974 section
+// 2.1), the extension follows the Message ID, or the Code on streams.
+const (
+	tklByteCode   = 13
+	tklByteAddend = 13
+	tklWordCode   = 14
+	tklWordAddend = 269
+	tklError      = 15
+
+	// DefaultMaxTokenLength is the token length of RFC 7252, longer tokens
+	// require Config.MaxTokenLength.
+	DefaultMaxTokenLength = 8
+	// ExtendedMaxTokenLength is the longest token RFC 8974 can encode.
+	ExtendedMaxTokenLength = tklWordAddend + 0xffff
+)
+
+// tokenLength returns the TKL nibble and extension bytes for a token of n
+// bytes.
+func tokenLength(n int) (byte, []byte, error) {
+	switch {
+	case n < tklByteAddend:
+		return byte(n), nil, nil
+	case n < tklWordAddend:
+		return tklByteCode, []byte{byte(n - tklByteAddend)}, nil
+	case n <= ExtendedMaxTokenLength:
+		ext := []byte{0, 0}
+		binary.BigEndian.PutUint16(ext, uint16(n-tklWordAddend))
+		return tklWordCode, ext, nil
+	}
+	return 0, nil, ErrInvalidTokenLen
+}
+
+// tokenExtLen returns the number of extension bytes that follow for a TKL
+// nibble.
+func tokenExtLen(tkl byte) (int, error) {
+	switch tkl {
+	case tklByteCode:
+		return 1, nil
+	case tklWordCode:
+		return 2, nil
+	case tklError:
+		return 0, ErrInvalidTokenLen
+	}
+	return 0, nil
+}
+
+// parseTokenLength returns the token length from the TKL nibble and its
+// extension bytes.
+func parseTokenLength(tkl byte, ext []byte) int {
+	switch tkl {
+	case tklByteCode:
+		return int(ext[0]) + tklByteAddend
+	case tklWordCode:
+		return int(binary.BigEndian.Uint16(ext)) + tklWordAddend
+	}
+	return int(tkl)
+}
+
 func (m *Message) headerSize() int {
 	tmpbuf := []byte{0, 0}
 	binary.BigEndian.PutUint16(tmpbuf, m.MessageID)
@@ -37,14 +96,31 @@ func (m *Message) headerSize() int {
 	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 	*/
 
+	tkl, tklExt, _ := tokenLength(len(m.Token))
 	buf := bytes.Buffer{}
 	buf.Write([]byte{
-		(1 << 6) | (uint8(m.Type) << 4) | uint8(0xf&len(m.Token)),
+		(1 << 6) | (uint8(m.Type) << 4) | tkl,
 		byte(m.Code),
 		tmpbuf[0], tmpbuf[1],
 	})
+	buf.Write(tklExt)
 	buf.Write(m.Token)
 
+	_ = m.marshalOptions(&buf)
+
+	return buf.Len()
+}
+
+// marshalOptions writes the options of this Message to buf, followed by the
+// payload marker if the Message carries a payload. An option value of an
+// unsupported type is returned as a *PanicError.
+func (m *Message) marshalOptions(buf *bytes.Buffer) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = newPanicError(r)
+		}
+	}()
+
 	/*
 	     0   1   2   3   4   5   6   7
 	   +---------------+---------------+
@@ -122,8 +198,7 @@ func (m *Message) headerSize() int {
 	if len(m.Payload) > 0 {
 		buf.Write([]byte{0xff})
 	}
-
-	return buf.Len()
+	return nil
 }
 
 // marshalBinary produces the binary form of this Message.
@@ -145,90 +220,21 @@ func (m *Message) marshalBinary() ([]byte, error) {
 	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 	*/
 
+	tkl, tklExt, err := tokenLength(len(m.Token))
+	if err != nil {
+		return nil, err
+	}
 	buf := bytes.Buffer{}
 	buf.Write([]byte{
-		(1 << 6) | (uint8(m.Type) << 4) | uint8(0xf&len(m.Token)),
+		(1 << 6) | (uint8(m.Type) << 4) | tkl,
 		byte(m.Code),
 		tmpbuf[0], tmpbuf[1],
 	})
+	buf.Write(tklExt)
 	buf.Write(m.Token)
 
-	/*
-	     0   1   2   3   4   5   6   7
-	   +---------------+---------------+
-	   |               |               |
-	   |  Option Delta | Option Length |   1 byte
-	   |               |               |
-	   +---------------+---------------+
-	   \                               \
-	   /         Option Delta          /   0-2 bytes
-	   \          (extended)           \
-	   +-------------------------------+
-	   \                               \
-	   /         Option Length         /   0-2 bytes
-	   \          (extended)           \
-	   +-------------------------------+
-	   \                               \
-	   /                               /
-	   \                               \
-	   /         Option Value          /   0 or more bytes
-	   \                               \
-	   /                               /
-	   \                               \
-	   +-------------------------------+
-
-	   See parseExtOption(), extendOption()
-	   and writeOptionHeader() below for implementation details
-	*/
-
-	extendOpt := func(opt int) (int, int) {
-		ext := 0
-		if opt >= extoptByteAddend {
-			if opt >= extoptWordAddend {
-				ext = opt - extoptWordAddend
-				opt = extoptWordCode
-			} else {
-				ext = opt - extoptByteAddend
-				opt = extoptByteCode
-			}
-		}
-		return opt, ext
-	}
-
-	writeOptHeader := func(delta, length int) {
-		d, dx := extendOpt(delta)
-		l, lx := extendOpt(length)
-
-		buf.WriteByte(byte(d<<4) | byte(l))
-
-		tmp := []byte{0, 0}
-		writeExt := func(opt, ext int) {
-			switch opt {
-			case extoptByteCode:
-				buf.WriteByte(byte(ext))
-			case extoptWordCode:
-				binary.BigEndian.PutUint16(tmp, uint16(ext))
-				buf.Write(tmp)
-			}
-		}
-
-		writeExt(d, dx)
-		writeExt(l, lx)
-	}
-
-	sort.Stable(&m.opts)
-
-	prev := 0
-
-	for _, o := range m.opts {
-		b := o.toBytes()
-		writeOptHeader(int(o.ID)-prev, len(b))
-		buf.Write(b)
-		prev = int(o.ID)
-	}
-
-	if len(m.Payload) > 0 {
-		buf.Write([]byte{0xff})
+	if err := m.marshalOptions(&buf); err != nil {
+		return nil, err
 	}
 
 	buf.Write(m.Payload)
@@ -254,22 +260,33 @@ func (m *Message) unmarshalBinary(data []byte) error {
 	}
 
 	m.Type = COAPType((data[0] >> 4) & 0x3)
-	tokenLen := int(data[0] & 0xf)
-	if tokenLen > 8 {
-		return ErrInvalidTokenLen
+	tklExtLen, err := tokenExtLen(data[0] & 0xf)
+	if err != nil {
+		return err
 	}
 
 	m.Code = COAPCode(data[1])
 	m.MessageID = binary.BigEndian.Uint16(data[2:4])
 
+	if len(data) < 4+tklExtLen {
+		return errors.New("coap: truncated")
+	}
+	tokenLen := parseTokenLength(data[0]&0xf, data[4:4+tklExtLen])
+	data = data[4+tklExtLen:]
+
 	if tokenLen > 0 {
 		m.Token = make([]byte, tokenLen)
 	}
-	if len(data) < 4+tokenLen {
+	if len(data) < tokenLen {
 		return errors.New("coap: truncated")
 	}
-	copy(m.Token, data[4:4+tokenLen])
-	b := data[4+tokenLen:]
+	copy(m.Token, data[:tokenLen])
+	return m.unmarshalOptions(data[tokenLen:])
+}
+
+// unmarshalOptions parses the options and payload that follow the token in
+// both the datagram and the stream encodings of a Message.
+func (m *Message) unmarshalOptions(b []byte) error {
 	prev := 0
 
 	parseExtOpt := func(opt int) (int, error) {
@@ -318,8 +335,11 @@ func (m *Message) unmarshalBinary(data []byte) error {
 			return errors.New("coap: truncated")
 		}
 
+		if prev+delta > 0xffff {
+			return errors.New("coap: invalid option number")
+		}
 		oid := OptionID(prev + delta)
-		opval := parseOptionValue(oid, b[:length])
+		opval := parseOptionValue(m.Code, oid, b[:length])
 		b = b[length:]
 		prev = int(oid)
 
@@ -330,3 +350,178 @@ func (m *Message) unmarshalBinary(data []byte) error {
 	m.Payload = b
 	return nil
 }
+
+const (
+	streamLenByteCode   = 13
+	streamLenByteAddend = 13
+	streamLenWordCode   = 14
+	streamLenWordAddend = 269
+	streamLenLongCode   = 15
+	streamLenLongAddend = 65805
+)
+
+// marshalStream produces the RFC 8323 stream form of this Message. Stream
+// messages carry neither a Type nor a Message ID.
+func (m *Message) marshalStream() ([]byte, error) {
+	tkl, tklExt, err := tokenLength(len(m.Token))
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	     0                   1                   2                   3
+	    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |  Len  |  TKL  | Extended Length (if any, as chosen by Len) ...
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |      Code     | Token (if any, TKL bytes) ...
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |   Options (if any) ...
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	   |1 1 1 1 1 1 1 1|    Payload (if any) ...
+	   +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	*/
+
+	body := bytes.Buffer{}
+	if err := m.marshalOptions(&body); err != nil {
+		return nil, err
+	}
+	body.Write(m.Payload)
+
+	l := body.Len()
+
+	buf := bytes.Buffer{}
+	switch {
+	case l < streamLenByteAddend:
+		buf.WriteByte(byte(l)<<4 | tkl)
+	case l < streamLenWordAddend:
+		buf.WriteByte(streamLenByteCode<<4 | tkl)
+		buf.WriteByte(byte(l - streamLenByteAddend))
+	case l < streamLenLongAddend:
+		tmp := []byte{0, 0}
+		binary.BigEndian.PutUint16(tmp, uint16(l-streamLenWordAddend))
+		buf.WriteByte(streamLenWordCode<<4 | tkl)
+		buf.Write(tmp)
+	default:
+		tmp := []byte{0, 0, 0, 0}
+		binary.BigEndian.PutUint32(tmp, uint32(l-streamLenLongAddend))
+		buf.WriteByte(streamLenLongCode<<4 | tkl)
+		buf.Write(tmp)
+	}
+	buf.WriteByte(byte(m.Code))
+	buf.Write(tklExt)
+	buf.Write(m.Token)
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// marshalWebsocket produces the RFC 8323 WebSocket form of this Message, the
+// stream form with a zero Len as the WebSocket frame carries the length.
+func (m *Message) marshalWebsocket() ([]byte, error) {
+	tkl, tklExt, err := tokenLength(len(m.Token))
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(tkl)
+	buf.WriteByte(byte(m.Code))
+	buf.Write(tklExt)
+	buf.Write(m.Token)
+	if err := m.marshalOptions(&buf); err != nil {
+		return nil, err
+	}
+	buf.Write(m.Payload)
+
+	return buf.Bytes(), nil
+}
+
+// unmarshalStream parses the given RFC 8323 stream or WebSocket frame as a
+// Message.
+func (m *Message) unmarshalStream(data []byte) error {
+	m.packetSize = len(data)
+	if len(data) < 2 {
+		return errors.New("coap: short packet")
+	}
+
+	extLen := streamExtLen(data[0] >> 4)
+	tklExtLen, err := tokenExtLen(data[0] & 0xf)
+	if err != nil {
+		return err
+	}
+	if len(data) < 1+extLen+1+tklExtLen {
+		return errors.New("coap: truncated")
+	}
+
+	m.Code = COAPCode(data[1+extLen])
+	tokenLen := parseTokenLength(data[0]&0xf, data[2+extLen:2+extLen+tklExtLen])
+	data = data[2+extLen+tklExtLen:]
+	if len(data) < tokenLen {
+		return errors.New("coap: truncated")
+	}
+	if tokenLen > 0 {
+		m.Token = make([]byte, tokenLen)
+		copy(m.Token, data[:tokenLen])
+	}
+	return m.unmarshalOptions(data[tokenLen:])
+}
+
+// streamExtLen returns the number of extended length bytes that follow the
+// first byte of a stream frame.
+func streamExtLen(l byte) int {
+	switch l {
+	case streamLenByteCode:
+		return 1
+	case streamLenWordCode:
+		return 2
+	case streamLenLongCode:
+		return 4
+	default:
+		return 0
+	}
+}
+
+// readStreamFrame reads exactly one RFC 8323 frame from r, rejecting frames
+// whose options and payload exceed maxSize bytes or whose token exceeds
+// maxTokenLen bytes.
+func readStreamFrame(r io.Reader, maxSize int, maxTokenLen int) ([]byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return nil, err
+	}
+	extLen := streamExtLen(hdr[0] >> 4)
+	tklExtLen, err := tokenExtLen(hdr[0] & 0xf)
+	if err != nil {
+		return nil, err
+	}
+	// the code and token length extension precede the token
+	if _, err := io.ReadFull(r, hdr[1:1+extLen+1+tklExtLen]); err != nil {
+		return nil, err
+	}
+
+	l := int(hdr[0] >> 4)
+	switch extLen {
+	case 1:
+		l = int(hdr[1]) + streamLenByteAddend
+	case 2:
+		l = int(binary.BigEndian.Uint16(hdr[1:3])) + streamLenWordAddend
+	case 4:
+		l = int(binary.BigEndian.Uint32(hdr[1:5])) + streamLenLongAddend
+	}
+	if maxSize > 0 && l > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	tokenLen := parseTokenLength(hdr[0]&0xf, hdr[2+extLen:2+extLen+tklExtLen])
+	if tokenLen > maxTokenLen {
+		return nil, ErrInvalidTokenLen
+	}
+
+	n := 1 + extLen + 1 + tklExtLen
+	frame := make([]byte, n+tokenLen+l)
+	copy(frame, hdr[:n])
+	if _, err := io.ReadFull(r, frame[n:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,182 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenLength(t *testing.T) {
+	tests := []struct {
+		n   int
+		tkl byte
+		ext []byte
+	}{
+		{0, 0, nil},
+		{8, 8, nil},
+		{12, 12, nil},
+		{13, 13, []byte{0}},
+		{268, 13, []byte{255}},
+		{269, 14, []byte{0, 0}},
+		{65804, 14, []byte{0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		token := bytes.Repeat([]byte{0xa5}, tt.n)
+		msg := &Message{Type: TypeConfirmable, Code: CodeGet, MessageID: 7, Token: token, Payload: []byte("p")}
+
+		data, err := msg.marshalBinary()
+		if err != nil {
+			t.Fatalf("%d: %v", tt.n, err)
+		}
+		if data[0]&0xf != tt.tkl || !bytes.Equal(data[4:4+len(tt.ext)], tt.ext) {
+			t.Errorf("%d: encoded as TKL %d with % x", tt.n, data[0]&0xf, data[4:4+len(tt.ext)])
+		}
+		got, err := parseMessage(data)
+		if err != nil || !bytes.Equal(got.Token, token) || string(got.Payload) != "p" {
+			t.Errorf("%d: parsed %d token bytes, %v", tt.n, len(got.Token), err)
+		}
+
+		data, err = msg.marshalStream()
+		if err != nil {
+			t.Fatalf("%d: %v", tt.n, err)
+		}
+		if _, err := readStreamFrame(bytes.NewReader(data), 0, tt.n-1); tt.n > 0 && !errors.Is(err, ErrInvalidTokenLen) {
+			t.Errorf("%d: frame read with a shorter limit, %v", tt.n, err)
+		}
+		frame, err := readStreamFrame(bytes.NewReader(data), 0, ExtendedMaxTokenLength)
+		if err != nil {
+			t.Fatalf("%d: %v", tt.n, err)
+		}
+		var stream Message
+		if err := stream.unmarshalStream(frame); err != nil || !bytes.Equal(stream.Token, token) || string(stream.Payload) != "p" {
+			t.Errorf("%d: parsed %d token bytes from stream, %v", tt.n, len(stream.Token), err)
+		}
+	}
+
+	msg := &Message{Type: TypeConfirmable, Code: CodeGet, Token: make([]byte, ExtendedMaxTokenLength+1)}
+	if _, err := msg.marshalBinary(); !errors.Is(err, ErrInvalidTokenLen) {
+		t.Errorf("token of %d bytes marshalled, %v", len(msg.Token), err)
+	}
+	if _, err := msg.marshalStream(); !errors.Is(err, ErrInvalidTokenLen) {
+		t.Errorf("token of %d bytes marshalled to a stream, %v", len(msg.Token), err)
+	}
+}
+
+func TestTokenLengthMalformed(t *testing.T) {
+	datagrams := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0x4f, 0x01, 0x00, 0x01}, ErrInvalidTokenLen},
+		{[]byte{0x4d, 0x01, 0x00, 0x01}, nil},
+		{[]byte{0x4e, 0x01, 0x00, 0x01, 0x00}, nil},
+		{[]byte{0x4d, 0x01, 0x00, 0x01, 0x00, 0xa5}, nil},
+		{[]byte{0x4e, 0x01, 0x00, 0x01, 0x00, 0x00, 0xa5}, nil},
+	}
+	for _, tt := range datagrams {
+		if _, err := parseMessage(tt.data); err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("% x: parsed, %v", tt.data, err)
+		}
+	}
+
+	streams := []struct {
+		data []byte
+		err  error
+	}{
+		{[]byte{0x0f, 0x01}, ErrInvalidTokenLen},
+		{[]byte{0x0d, 0x01}, nil},
+		{[]byte{0x0e, 0x01, 0x00}, nil},
+		{[]byte{0x0d, 0x01, 0x00, 0xa5}, nil},
+	}
+	for _, tt := range streams {
+		var msg Message
+		if err := msg.unmarshalStream(tt.data); err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("% x: parsed from stream, %v", tt.data, err)
+		}
+		if _, err := readStreamFrame(bytes.NewReader(tt.data), 0, ExtendedMaxTokenLength); err == nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("% x: frame read, %v", tt.data, err)
+		}
+	}
+}
+
+// TestTokenLengthReject sends tokens longer than Config.MaxTokenLength, a
+// confirmable request is answered with a Reset and others are dropped.
+func TestTokenLengthReject(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	s := newTestServer(t, nil)
+	long := newTestServer(t, &Config{MaxTokenLength: 16})
+
+	exchange := func(s *Server, msg *Message) *Message {
+		t.Helper()
+		port, _ := s.GetPorts()
+		data, err := msg.marshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := peer.WriteToUDP(data, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		n, err := peer.Read(buf)
+		if err != nil {
+			return nil
+		}
+		rsp, err := parseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &rsp
+	}
+
+	token := bytes.Repeat([]byte{1}, DefaultMaxTokenLength+1)
+	rsp := exchange(s, &Message{Type: TypeConfirmable, Code: CodeGet, MessageID: 0x42, Token: token})
+	if rsp == nil || rsp.Type != TypeReset || rsp.Code != CodeEmpty || rsp.MessageID != 0x42 || len(rsp.Token) != 0 {
+		t.Errorf("confirmable request answered with %+v", rsp)
+	}
+	if rsp := exchange(s, &Message{Type: TypeNonConfirmable, Code: CodeGet, MessageID: 0x43, Token: token}); rsp != nil {
+		t.Errorf("non-confirmable request answered with %+v", rsp)
+	}
+
+	rsp = exchange(long, &Message{Type: TypeConfirmable, Code: CodeGet, MessageID: 0x44, Token: token})
+	if rsp == nil || rsp.Type != TypeAcknowledgement || !bytes.Equal(rsp.Token, token) {
+		t.Errorf("request with a token below the limit answered with %+v", rsp)
+	}
+}
+
+// TestExtendedTokenLengthCSM checks the Extended-Token-Length of a peer is
+// limited to the range of RFC 8974.
+func TestExtendedTokenLengthCSM(t *testing.T) {
+	tests := []struct {
+		etl  uint32
+		want int
+	}{
+		{0, DefaultMaxTokenLength},
+		{4, DefaultMaxTokenLength},
+		{8, 8},
+		{1000, 1000},
+		{ExtendedMaxTokenLength, ExtendedMaxTokenLength},
+		{ExtendedMaxTokenLength + 1, ExtendedMaxTokenLength},
+		{0xffffff, ExtendedMaxTokenLength},
+	}
+	l := &TcpListener{}
+	for _, tt := range tests {
+		c := &tcpConn{listener: l, maxTokenLength: DefaultMaxTokenLength}
+		csm := &Message{Code: SignalCodeCSM}
+		csm.WithOption(OptSignalExtendedTokenLength, tt.etl, true)
+		l.signal(c, csm)
+		if _, got := c.limits(); got != tt.want {
+			t.Errorf("%d: limited to %d, expected %d", tt.etl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+// Middleware wraps a RouteCallback with behavior shared by several routes,
+// e.g. authorization or logging. It may answer the request itself instead of
+// calling next.
+type Middleware func(next RouteCallback) RouteCallback
+
+// Use adds middleware run for every route, including the ~keepalive route,
+// in the order given and before the middleware of the route itself.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// WithMiddleware adds middleware run for every method of the route.
+func WithMiddleware(middleware ...Middleware) RouteOption {
+	return func(route *routeEntry) {
+		route.middleware = append(route.middleware, middleware...)
+	}
+}
+
+// chain wraps callback so that the first middleware runs first.
+func chain(middleware []Middleware, callback RouteCallback) RouteCallback {
+	if callback == nil {
+		return nil
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		callback = middleware[i](callback)
+	}
+	return callback
+}
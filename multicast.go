@@ -0,0 +1,205 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// All CoAP Nodes multicast addresses (RFC 7252 section 12.8).
+const (
+	MulticastIPv4          = "224.0.1.187"
+	MulticastIPv6LinkLocal = "ff02::fd"
+	MulticastIPv6SiteLocal = "ff05::fd"
+)
+
+// MulticastListener receives the requests sent to a multicast group, the
+// responses are sent from the unicast udp listener of the Server.
+type MulticastListener struct {
+	name  string
+	group *net.UDPAddr
+	ifi   *net.Interface
+	// socket is nil when the group is joined on the socket of the unicast
+	// listener
+	socket   *net.UDPConn
+	unicast  *UdpListener
+	receive  TransportReceiveFunc
+	shutdown bool
+}
+
+// JoinMulticast joins the multicast group at addr, e.g. "224.0.1.187:5683",
+// on ifi or the system default interface if ifi is nil. Requests received
+// from the group are marked with Metadata.Multicast. A group on the port of
+// the udp listener is joined on its socket, which must then not be bound to
+// a unicast address.
+func (s *Server) JoinMulticast(addr string, ifi *net.Interface) error {
+	if s.udpListener == nil {
+		return errors.New("coap: multicast requires a udp listener")
+	}
+	gaddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	if !gaddr.IP.IsMulticast() {
+		return errors.New("coap: not a multicast address: " + addr)
+	}
+	l := &MulticastListener{name: "multicast:" + gaddr.String(), group: gaddr, ifi: ifi, unicast: s.udpListener}
+	if gaddr.Port != s.udpListener.socket.LocalAddr().(*net.UDPAddr).Port {
+		if l.socket, err = net.ListenMulticastUDP("udp", ifi, gaddr); err != nil {
+			return err
+		}
+	}
+	if err := s.AddTransport(l); err != nil {
+		if l.socket != nil {
+			_ = l.socket.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (l *MulticastListener) Name() string {
+	return l.name
+}
+
+func (l *MulticastListener) Listen(receive TransportReceiveFunc) error {
+	l.receive = receive
+	if l.socket == nil {
+		return l.unicast.joinGroup(l)
+	}
+	go l.reader()
+	return nil
+}
+
+func (l *MulticastListener) reader() {
+	var rawReq = make([]byte, 8192)
+
+	for {
+		rawLen, from, err := l.socket.ReadFromUDP(rawReq)
+		if err != nil {
+			if l.shutdown {
+				logDebug(nil, nil, "coap: multicast reader shutdown")
+				return
+			}
+			logWarn(nil, err, "coap: error reading COAP multicast packet")
+			go l.reader()
+			return
+		}
+		newReq := append([]byte(nil), rawReq[:rawLen]...)
+		sniffActivity("udp", SniffRead, from.String(), l.socket.LocalAddr().String(), newReq)
+		go l.receive(newReq, from.String())
+	}
+}
+
+// WriteTo sends data from the unicast udp listener, responses to multicast
+// requests never come from the group address (RFC 7252 section 8.2).
+func (l *MulticastListener) WriteTo(addr string, data []byte) error {
+	return l.unicast.WriteTo(addr, data)
+}
+
+// HasEndpoint is false, messages are never sent through the group listener.
+func (l *MulticastListener) HasEndpoint(addr string) bool {
+	return false
+}
+
+func (l *MulticastListener) LocalAddr() string {
+	if l.socket == nil {
+		return l.unicast.LocalAddr()
+	}
+	return l.socket.LocalAddr().String()
+}
+
+func (l *MulticastListener) Close() error {
+	l.shutdown = true
+	if l.socket == nil {
+		return l.unicast.leaveGroup(l)
+	}
+	return l.socket.Close()
+}
+
+// multicastReply sends rsp to a request received from a multicast group after
+// a random delay within the leisure period (RFC 7252 section 8.2). Error and
+// empty responses are suppressed, there is nothing useful in them for the
+// group (RFC 7390 section 2.7).
+func (s *Server) multicastReply(t Transport, req *Message, rsp *Message, data []byte) {
+	if rsp == nil || rsp.Code == CodeEmpty || rsp.Type == TypeReset || rsp.Code >= RspCodeBadRequest {
+		logDebug(req, nil, "multicast response suppressed")
+		return
+	}
+	var delay time.Duration
+	if s.config.MulticastLeisure > 0 {
+		delay = time.Duration(rand.Int63n(int64(s.config.MulticastLeisure)))
+	}
+	to := req.Meta.RemoteAddr
+	time.AfterFunc(delay, func() {
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err := t.WriteTo(to, data); err != nil {
+			logWarn(rsp, err, "coap: error writing coap multicast response")
+		}
+	})
+}
+
+// SendMulticast sends msg as a non-confirmable request to the multicast group
+// at addr and collects the responses that arrive within window, each carries
+// the address of its responder in Metadata.RemoteAddr (RFC 7252 section 8.1).
+// When ctx is done first, the responses collected so far are returned with
+// ctx.Err().
+func (s *Server) SendMulticast(ctx context.Context, addr string, msg *Message, window time.Duration, options *SendOptions) ([]*Message, error) {
+	if !s.beginExchange() {
+		return nil, ErrServerClosed
+	}
+	defer s.endExchange()
+
+	if options == nil {
+		options = s.NewOptions()
+	}
+	t, err := s.transportFor(addr, options)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Type = TypeNonConfirmable
+	msg.Meta.RemoteAddr = addr
+	msg.Meta.ListenerName = t.Name()
+
+	var mux sync.Mutex
+	var rsps []*Message
+	s.pendingSaveMulti(msg, func(rsp *Message) {
+		mux.Lock()
+		rsps = append(rsps, rsp)
+		mux.Unlock()
+	})
+	defer s.pendingDelete(msg)
+
+	data, err := s.marshalDatagram(msg)
+	if err == nil {
+		err = t.WriteTo(addr, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logDebug(msg, nil, "sent multicast message (window:%0.2fs)", window.Seconds())
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.ctx.Done():
+		err = ErrServerClosed
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	return append([]*Message(nil), rsps...), err
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+func multicastInterface(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for i := range ifis {
+		if ifis[i].Flags&net.FlagUp != 0 && ifis[i].Flags&net.FlagMulticast != 0 {
+			return &ifis[i]
+		}
+	}
+	t.Skip("no multicast interface")
+	return nil
+}
+
+// TestMulticastUnicastPort joins a group on the port of the udp listener, as
+// done for the default port 5683, on an ephemeral port.
+func TestMulticastUnicastPort(t *testing.T) {
+	ifi := multicastInterface(t)
+	srv, err := NewServer(&Config{MulticastLeisure: time.Millisecond * 10}, ":0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	port, _ := srv.GetPorts()
+	group := fmt.Sprintf("%s:%d", MulticastIPv4, port)
+	multicast := make(chan bool, 2)
+	srv.AddRoute("hello", func(req *Message) *Message {
+		multicast <- req.Meta.Multicast
+		return req.MakeReply(RspCodeContent, []byte("hi"))
+	})
+	if err := srv.JoinMulticast(group, ifi); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewServer(nil, ":0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	p := ipv4.NewPacketConn(client.udpListener.socket)
+	if err := p.SetMulticastInterface(ifi); err != nil {
+		t.Skip(err)
+	}
+	_ = p.SetMulticastLoopback(true)
+
+	req := NewMessage()
+	req.Code = CodeGet
+	req.WithPathString("hello")
+	rsps, err := client.SendMulticast(context.Background(), group, req, time.Millisecond*500, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsps) != 1 || string(rsps[0].Payload) != "hi" {
+		t.Fatalf("unexpected multicast responses: %v", rsps)
+	}
+	if !<-multicast {
+		t.Fatal("request from the group not marked multicast")
+	}
+
+	// the unicast listener sharing the socket is unaffected
+	req = NewMessage()
+	req.Type = TypeConfirmable
+	req.Code = CodeGet
+	req.WithPathString("hello")
+	rsp, err := client.Send(fmt.Sprintf("127.0.0.1:%d", port), req, nil)
+	if err != nil || string(rsp.Payload) != "hi" {
+		t.Fatal(rsp, err)
+	}
+	if <-multicast {
+		t.Fatal("unicast request marked multicast")
+	}
+}
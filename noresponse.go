@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+// No-Response option values (RFC 7967 section 2.1), they are combined to
+// suppress several response classes.
+const (
+	NoResponseSuccess     uint32 = 0x02
+	NoResponseClientError uint32 = 0x08
+	NoResponseServerError uint32 = 0x10
+	NoResponseAll                = NoResponseSuccess | NoResponseClientError | NoResponseServerError
+)
+
+// suppressesResponse returns true if the No-Response option of this request
+// asks for responses with code to be suppressed.
+func (m *Message) suppressesResponse(code COAPCode) bool {
+	nr, ok := m.Option(OptNoResponse).(uint32)
+	if !ok || code == CodeEmpty {
+		return false
+	}
+	class := uint(code) >> 5
+	return class > 0 && nr&(1<<(class-1)) != 0
+}
+
+// withNoResponse adds the No-Response option asked for in options to a
+// request, an OSCORE request already carries it encrypted.
+func (m *Message) withNoResponse(options *SendOptions) {
+	if options != nil && options.NoResponse != 0 && m.IsRequest() && m.Code != CodeEmpty && m.Option(OptOscore) == nil {
+		m.WithOption(OptNoResponse, options.NoResponse, true)
+	}
+}
@@ -0,0 +1,264 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNoResponsePendingCleanup(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.AddRoute("telemetry", func(req *Message) *Message {
+		return req.MakeReply(RspCodeChanged, nil)
+	})
+	client := newTestServer(t, nil)
+	addr := srv.udpListener.LocalAddr()
+
+	for i := 0; i < 50; i++ {
+		rsp, err := client.Send(addr, newTestRequest(TypeConfirmable, CodePost, "telemetry"), client.NewOptions().WithNoResponse(NoResponseAll))
+		if rsp != nil || err != nil {
+			t.Fatal(rsp, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		rsp, err := client.SendAsync(addr, newTestRequest(TypeConfirmable, CodePost, "telemetry"), client.NewOptions().WithNoResponse(NoResponseAll)).Wait(ctx)
+		cancel()
+		if rsp != nil || err != nil {
+			t.Fatal(rsp, err)
+		}
+	}
+	if tokens, mids := client.pendingCount(); tokens != 0 || mids != 0 {
+		t.Fatalf("pending exchanges left behind: %d tokens, %d message ids", tokens, mids)
+	}
+}
+
+func TestNoResponseSuppresses(t *testing.T) {
+	tests := []struct {
+		nr   interface{}
+		code COAPCode
+		want bool
+	}{
+		{nil, RspCodeContent, false},
+		{uint32(0), RspCodeContent, false},
+		{NoResponseSuccess, RspCodeContent, true},
+		{NoResponseSuccess, RspCodeContinue, true},
+		{NoResponseSuccess, RspCodeNotFound, false},
+		{NoResponseSuccess, RspCodeInternalServerError, false},
+		{NoResponseClientError, RspCodeChanged, false},
+		{NoResponseClientError, RspCodeNotFound, true},
+		{NoResponseClientError, RspCodeInternalServerError, false},
+		{NoResponseServerError, RspCodeBadRequest, false},
+		{NoResponseServerError, RspCodeServiceUnavailable, true},
+		{NoResponseSuccess | NoResponseServerError, RspCodeCreated, true},
+		{NoResponseSuccess | NoResponseServerError, RspCodeForbidden, false},
+		{NoResponseSuccess | NoResponseServerError, RspCodeInternalServerError, true},
+		{NoResponseAll, CodeEmpty, false},
+	}
+	for _, tt := range tests {
+		req := newTestRequest(TypeConfirmable, CodePost, "x")
+		if tt.nr != nil {
+			req.WithOption(OptNoResponse, tt.nr, true)
+		}
+		if got := req.suppressesResponse(tt.code); got != tt.want {
+			t.Errorf("no-response %v code %s: suppressed %t", tt.nr, tt.code.NumberString(), got)
+		}
+	}
+}
+
+// TestNoResponseMask sends requests whose responses are partly suppressed,
+// the responses of the other classes still arrive.
+func TestNoResponseMask(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.AddRoute("ok", func(req *Message) *Message {
+		return req.MakeReply(RspCodeChanged, nil)
+	})
+	srv.AddRoute("fail", func(req *Message) *Message {
+		return req.MakeReply(RspCodeInternalServerError, nil)
+	})
+	client := newTestServer(t, nil)
+	addr := srv.udpListener.LocalAddr()
+
+	tests := []struct {
+		nr   uint32
+		path string
+		want COAPCode
+	}{
+		{NoResponseSuccess, "ok", CodeEmpty},
+		{NoResponseSuccess, "missing", RspCodeNotFound},
+		{NoResponseSuccess, "fail", RspCodeInternalServerError},
+		{NoResponseClientError, "ok", RspCodeChanged},
+		{NoResponseClientError, "missing", CodeEmpty},
+		{NoResponseServerError, "ok", RspCodeChanged},
+		{NoResponseServerError, "fail", CodeEmpty},
+		{NoResponseClientError | NoResponseServerError, "ok", RspCodeChanged},
+		{NoResponseClientError | NoResponseServerError, "missing", CodeEmpty},
+	}
+	for _, tt := range tests {
+		for _, typ := range []COAPType{TypeConfirmable, TypeNonConfirmable} {
+			rsp, err := client.Send(addr, newTestRequest(typ, CodePost, tt.path), client.NewOptions().WithNoResponse(tt.nr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ == TypeNonConfirmable {
+				// non-confirmable requests with No-Response are not waited
+				// for
+				if rsp != nil {
+					t.Errorf("%x %s non-confirmable: answered %s", tt.nr, tt.path, rsp.Code.NumberString())
+				}
+				continue
+			}
+			got := CodeEmpty
+			if rsp != nil {
+				got = rsp.Code
+			}
+			if got != tt.want {
+				t.Errorf("%x %s: answered %s, expected %s", tt.nr, tt.path, got.NumberString(), tt.want.NumberString())
+			}
+		}
+	}
+}
+
+// TestNoResponseEmptyAck checks a confirmable request with a suppressed
+// response is acknowledged with an empty ack, a non-confirmable one is not
+// answered at all.
+func TestNoResponseEmptyAck(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	srv := newTestServer(t, nil)
+	srv.AddRoute("ok", func(req *Message) *Message {
+		return req.MakeReply(RspCodeChanged, []byte("done"))
+	})
+	port, _ := srv.GetPorts()
+
+	exchange := func(typ COAPType, mid uint16, nr uint32) *Message {
+		t.Helper()
+		req := newTestRequest(typ, CodePost, "ok")
+		req.MessageID = mid
+		req.Token = []byte{1, 2, 3, 4}
+		req.WithOption(OptNoResponse, nr, true)
+		data, _ := req.marshalBinary()
+		if _, err := peer.WriteToUDP(data, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		_ = peer.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		n, err := peer.Read(buf)
+		if err != nil {
+			return nil
+		}
+		rsp, err := parseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &rsp
+	}
+
+	rsp := exchange(TypeConfirmable, 0x100, NoResponseSuccess)
+	if rsp == nil || rsp.Type != TypeAcknowledgement || rsp.Code != CodeEmpty || rsp.MessageID != 0x100 || len(rsp.Token) != 0 || len(rsp.Payload) != 0 {
+		t.Errorf("suppressed confirmable request answered with %+v", rsp)
+	}
+	// a retransmission is acknowledged again
+	if rsp := exchange(TypeConfirmable, 0x100, NoResponseSuccess); rsp == nil || rsp.Type != TypeAcknowledgement || rsp.Code != CodeEmpty {
+		t.Errorf("retransmitted request answered with %+v", rsp)
+	}
+	if rsp := exchange(TypeNonConfirmable, 0x101, NoResponseSuccess); rsp != nil {
+		t.Errorf("suppressed non-confirmable request answered with %+v", rsp)
+	}
+	if rsp := exchange(TypeConfirmable, 0x102, NoResponseClientError); rsp == nil || rsp.Code != RspCodeChanged || string(rsp.Payload) != "done" {
+		t.Errorf("request answered with %+v", rsp)
+	}
+}
+
+// TestNoResponseBlockwise uploads a payload in three blocks, only the last one
+// carries No-Response and the others wait for their 2.31 Continue.
+func TestNoResponseBlockwise(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	client := newTestServer(t, nil)
+
+	payload := make([]byte, 1200)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	done := make(chan error, 1)
+	go func() {
+		req := newTestRequest(TypeConfirmable, CodePost, "upload").WithPayload(payload)
+		rsp, err := client.Send(peer.LocalAddr().String(), req, client.NewOptions().WithBlockSize(512).WithNoResponse(NoResponseSuccess))
+		if err == nil && rsp != nil {
+			err = fmt.Errorf("answered with %s", rsp.Code.NumberString())
+		}
+		done <- err
+	}()
+
+	var received []byte
+	var tag []byte
+	buf := make([]byte, 1500)
+	for num := 0; num < 3; num++ {
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := peer.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := parseMessage(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		block1 := req.GetBlock1()
+		if block1 == nil || block1.Num != num || block1.More != (num < 2) {
+			t.Fatalf("block %d sent as %+v", num, block1)
+		}
+		if t0, _ := req.Option(OptRequestTag).([]byte); num == 0 {
+			tag = append([]byte(nil), t0...)
+		} else if !bytes.Equal(t0, tag) {
+			t.Errorf("block %d tagged %x, expected %x", num, t0, tag)
+		}
+		received = append(received, req.Payload...)
+
+		var rsp *Message
+		if num < 2 {
+			if req.Option(OptNoResponse) != nil {
+				t.Errorf("block %d carries No-Response", num)
+			}
+			rsp = &Message{Type: TypeAcknowledgement, Code: RspCodeContinue, MessageID: req.MessageID, Token: req.Token}
+			rsp.WithBlock1(block1)
+		} else {
+			if nr, _ := req.Option(OptNoResponse).(uint32); nr != NoResponseSuccess {
+				t.Errorf("last block carries No-Response %v", req.Option(OptNoResponse))
+			}
+			rsp = &Message{Type: TypeAcknowledgement, Code: CodeEmpty, MessageID: req.MessageID}
+		}
+		data, _ := rsp.marshalBinary()
+		if _, err := peer.WriteToUDP(data, from); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload did not finish")
+	}
+	if !bytes.Equal(received, payload) {
+		t.Errorf("received %d bytes", len(received))
+	}
+	if tokens, mids := client.pendingCount(); tokens != 0 || mids != 0 {
+		t.Errorf("pending exchanges left behind: %d tokens, %d message ids", tokens, mids)
+	}
+}
@@ -1,6 +1,9 @@
 package coap
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type nstart struct {
 	count int
@@ -8,65 +11,131 @@ type nstart struct {
 	mux   sync.Mutex
 }
 
-var nstartMap = map[string]*nstart{}
-var nstartMux sync.Mutex
-
-func nstartInc(addr string, nStart int) {
+// nstartInc waits until fewer than nStart exchanges with addr are
+// outstanding and takes a slot, unless ctx is done first.
+func (s *Server) nstartInc(ctx context.Context, addr string, nStart int) error {
 	if nStart > 0 {
-		nstartMux.Lock()
-		if s, found := nstartMap[addr]; found {
-			nstartMux.Unlock()
-			s.cond.L.Lock()
-			for s.count >= nStart {
-				s.cond.Wait()
+		s.nstartMux.Lock()
+		if ns, found := s.nstartMap[addr]; found {
+			s.nstartMux.Unlock()
+			if ctx.Done() != nil {
+				stop := make(chan struct{})
+				defer close(stop)
+				go func() {
+					select {
+					case <-ctx.Done():
+						ns.cond.L.Lock()
+						ns.cond.Broadcast()
+						ns.cond.L.Unlock()
+					case <-stop:
+					}
+				}()
+			}
+			ns.cond.L.Lock()
+			for ns.count >= nStart {
+				if err := ctx.Err(); err != nil {
+					ns.cond.L.Unlock()
+					return err
+				}
+				ns.cond.Wait()
 			}
-			s.count++
-			s.cond.L.Unlock()
+			ns.count++
+			ns.cond.L.Unlock()
 		} else {
 			ns := &nstart{count: 1}
 			ns.cond = sync.NewCond(&ns.mux)
-			nstartMap[addr] = ns
-			nstartMux.Unlock()
+			s.nstartMap[addr] = ns
+			s.nstartMux.Unlock()
 		}
 	}
+	return nil
+}
+
+// nstartTryInc takes a slot for an exchange with addr if fewer than nStart
+// are outstanding, without waiting.
+func (s *Server) nstartTryInc(addr string, nStart int) bool {
+	if nStart <= 0 {
+		return true
+	}
+	s.nstartMux.Lock()
+	ns, found := s.nstartMap[addr]
+	if !found {
+		ns = &nstart{count: 1}
+		ns.cond = sync.NewCond(&ns.mux)
+		s.nstartMap[addr] = ns
+		s.nstartMux.Unlock()
+		return true
+	}
+	s.nstartMux.Unlock()
+	ns.cond.L.Lock()
+	defer ns.cond.L.Unlock()
+	if ns.count >= nStart {
+		return false
+	}
+	ns.count++
+	return true
 }
 
-func nstartCount(addr string, nStart int) int {
-	nstartMux.Lock()
-	if s, found := nstartMap[addr]; found {
-		nstartMux.Unlock()
-		if s.count > nStart {
-			return s.count - nStart
+func (s *Server) nstartCount(addr string, nStart int) int {
+	s.nstartMux.Lock()
+	if ns, found := s.nstartMap[addr]; found {
+		s.nstartMux.Unlock()
+		if ns.count > nStart {
+			return ns.count - nStart
 		} else {
 			return 0
 		}
 	}
-	nstartMux.Unlock()
+	s.nstartMux.Unlock()
 	return -1
 }
 
-func nstartDec(addr string) {
-	nstartMux.Lock()
-	if s, found := nstartMap[addr]; found {
-		nstartMux.Unlock()
-		s.cond.L.Lock()
-		s.count--
-		s.cond.Signal()
-		s.cond.L.Unlock()
+func (s *Server) nstartDec(addr string) {
+	s.nstartMux.Lock()
+	if ns, found := s.nstartMap[addr]; found {
+		s.nstartMux.Unlock()
+		ns.cond.L.Lock()
+		ns.count--
+		// waiters that gave up may be woken too, let them all check
+		ns.cond.Broadcast()
+		ns.cond.L.Unlock()
 	} else {
-		nstartMux.Unlock()
+		s.nstartMux.Unlock()
 	}
 }
 
+// NstartClear forgets the outstanding exchanges with addr.
+func (s *Server) NstartClear(addr string) {
+	s.nstartMux.Lock()
+	delete(s.nstartMap, addr)
+	s.nstartMux.Unlock()
+}
+
+// NstartEntryCount returns the number of endpoints tracked for NSTART.
+func (s *Server) NstartEntryCount() int {
+	s.nstartMux.Lock()
+	l := len(s.nstartMap)
+	s.nstartMux.Unlock()
+	return l
+}
+
+// NstartClear forgets the outstanding exchanges with addr on every Server.
+//
+// Deprecated: use Server.NstartClear.
 func NstartClear(addr string) {
-	nstartMux.Lock()
-	delete(nstartMap, addr)
-	nstartMux.Unlock()
+	eachServer(func(s *Server) {
+		s.NstartClear(addr)
+	})
 }
 
+// NstartEntryCount returns the number of endpoints tracked for NSTART over
+// every Server.
+//
+// Deprecated: use Server.NstartEntryCount.
 func NstartEntryCount() int {
-	nstartMux.Lock()
-	l := len(nstartMap)
-	nstartMux.Unlock()
+	l := 0
+	eachServer(func(s *Server) {
+		l += s.NstartEntryCount()
+	})
 	return l
 }
@@ -5,11 +5,10 @@
 package coap
 
 import (
+	"context"
 	"sync"
 )
 
-var observeMap sync.Map
-
 type ObserveCallback func(req *Message, arg interface{}) error
 type ObserveNotFoundCallback func(req *Message) bool
 
@@ -17,9 +16,15 @@ type Observation struct {
 	path     string
 	callback ObserveCallback
 	arg      interface{}
+	oscore   *oscoreRequest
 }
 
 func (s *Server) Observe(addr string, code COAPCode, path string, payload []byte, encoding MediaType, callback ObserveCallback, arg interface{}, options *SendOptions) (string, error) {
+	return s.ObserveContext(context.Background(), addr, code, path, payload, encoding, callback, arg, options)
+}
+
+// ObserveContext is Observe that gives up registering when ctx is done.
+func (s *Server) ObserveContext(ctx context.Context, addr string, code COAPCode, path string, payload []byte, encoding MediaType, callback ObserveCallback, arg interface{}, options *SendOptions) (string, error) {
 	if options == nil {
 		options = s.NewOptions()
 	}
@@ -37,17 +42,17 @@ func (s *Server) Observe(addr string, code COAPCode, path string, payload []byte
 		req.Payload = payload
 	}
 
-	rsp, err := s.Send(addr, req, options)
+	rsp, err := s.SendContext(ctx, addr, req, options)
 	if err != nil {
 		return "", err
 	}
 
-	err = RspCodeToError(rsp.Code)
+	err = ResponseToError(rsp)
 	if err != nil {
 		return "", err
 	}
 
-	observeMap.Store(string(req.Token), &Observation{path: path, callback: callback, arg: arg})
+	s.observations.Store(string(req.Token), &Observation{path: path, callback: callback, arg: arg, oscore: req.oscoreSent})
 
 	_ = callback(rsp, arg)
 
@@ -55,6 +60,12 @@ func (s *Server) Observe(addr string, code COAPCode, path string, payload []byte
 }
 
 func (s *Server) ObserveCancel(addr string, path string, token string, options *SendOptions) error {
+	return s.ObserveCancelContext(context.Background(), addr, path, token, options)
+}
+
+// ObserveCancelContext is ObserveCancel that stops waiting for the
+// deregistration to be answered when ctx is done.
+func (s *Server) ObserveCancelContext(ctx context.Context, addr string, path string, token string, options *SendOptions) error {
 	if options == nil {
 		options = s.NewOptions()
 	}
@@ -64,14 +75,15 @@ func (s *Server) ObserveCancel(addr string, path string, token string, options *
 	req.WithPathString(path)
 	req.Token = []byte(token)
 
-	observeMap.Delete(token)
+	s.observations.Delete(token)
+	observations.Delete(token)
 
-	rsp, err := s.Send(addr, req, options)
+	rsp, err := s.SendContext(ctx, addr, req, options)
 	if err != nil {
 		return err
 	}
 
-	err = RspCodeToError(rsp.Code)
+	err = ResponseToError(rsp)
 	if err != nil {
 		return err
 	}
@@ -79,29 +91,78 @@ func (s *Server) ObserveCancel(addr string, path string, token string, options *
 	return nil
 }
 
+// ObserveRegister routes notifications with token to callback, e.g. for an
+// observation registered before a restart.
+func (s *Server) ObserveRegister(token string, path string, callback ObserveCallback, arg interface{}) {
+	s.observations.Store(token, &Observation{path: path, callback: callback, arg: arg})
+}
+
+// ObserveTokens calls callback with the token of every observation.
+func (s *Server) ObserveTokens(callback func(string)) {
+	s.observations.Range(func(key interface{}, value interface{}) bool {
+		callback(key.(string))
+		return true
+	})
+}
+
+// observations holds the observations registered with the deprecated
+// ObserveRegister, every Server routes notifications to them.
+var observations sync.Map
+
+// ObserveRegister registers the observation with every Server, including
+// those created later.
+//
+// Deprecated: use Server.ObserveRegister.
 func ObserveRegister(token string, path string, callback ObserveCallback, arg interface{}) {
-	observeMap.Store(token, &Observation{path: path, callback: callback, arg: arg})
-	return
+	observations.Store(token, &Observation{path: path, callback: callback, arg: arg})
 }
 
+// ObserveTokens calls callback with the token of every observation
+// registered with ObserveRegister and of every Server.
+//
+// Deprecated: use Server.ObserveTokens.
 func ObserveTokens(callback func(string)) {
-	observeMap.Range(func(key interface{}, value interface{}) bool {
+	observations.Range(func(key interface{}, value interface{}) bool {
 		callback(key.(string))
 		return true
 	})
+	eachServer(func(s *Server) {
+		s.ObserveTokens(callback)
+	})
 }
 
 func (s *Server) getObserve(msg *Message) *Observation {
-	c, found := observeMap.Load(string(msg.Token))
+	c, found := s.loadObserve(string(msg.Token))
 	if found {
-		return c.(*Observation)
+		return c
 	} else {
 		if s.config.ObserveNotFoundCallback != nil && s.config.ObserveNotFoundCallback(msg) {
-			c, found = observeMap.Load(string(msg.Token))
+			c, found = s.loadObserve(string(msg.Token))
 			if found {
-				return c.(*Observation)
+				return c
 			}
 		}
 	}
 	return nil
 }
+
+// loadObserve returns the observation of token, falling back to those
+// registered with the deprecated ObserveRegister.
+func (s *Server) loadObserve(token string) (*Observation, bool) {
+	c, found := s.observations.Load(token)
+	if !found {
+		c, found = observations.Load(token)
+	}
+	if !found {
+		return nil, false
+	}
+	return c.(*Observation), true
+}
+
+// verify decrypts a notification of an observation registered with OSCORE.
+func (o *Observation) verify(msg *Message) error {
+	if o.oscore == nil {
+		return nil
+	}
+	return o.oscore.unprotectResponse(msg)
+}
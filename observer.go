@@ -0,0 +1,228 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// observer is a remote endpoint observing a resource of this Server (RFC 7641).
+type observer struct {
+	addr    string
+	path    string
+	req     *Message
+	typ     COAPType
+	seq     uint32
+	lastMid uint16
+	lastCon time.Time
+	mux     sync.Mutex
+}
+
+func observerKey(addr string, token []byte) string {
+	return addr + "|" + string(token)
+}
+
+// observeRequest updates the observers of the Server for a GET or FETCH
+// request and its response, adding the Observe option to rsp when req
+// registers a new observer.
+func (s *Server) observeRequest(req *Message, rsp *Message) {
+	if req.Code != CodeGet && req.Code != CodeFetch {
+		return
+	}
+	key := observerKey(req.Meta.RemoteAddr, req.Token)
+
+	ov := req.Option(OptObserve)
+	if ov == nil || optionUint(ov) != 0 || rsp == nil || !rsp.IsSuccess() {
+		// a request without Observe=0 from the same endpoint and token ends
+		// the observation (RFC 7641 section 4.1)
+		if _, found := s.observers.LoadAndDelete(key); found {
+			logDebug(req, nil, "observer removed")
+		}
+		return
+	}
+
+	o := &observer{
+		addr:    req.Meta.RemoteAddr,
+		path:    req.PathString(),
+		req:     req,
+		typ:     req.Type,
+		lastCon: time.Now(),
+	}
+	if oi, found := s.observers.Load(key); found {
+		// re-registration keeps the sequence going
+		o.seq = oi.(*observer).seq
+	}
+	o.seq = (o.seq + 1) & 0xffffff
+	rsp.WithOption(OptObserve, o.seq, true)
+	s.observers.Store(key, o)
+	logDebug(req, nil, "observer registered for %s", o.path)
+}
+
+// observeReset removes the observer a reset message refers to.
+func (s *Server) observeReset(req *Message) {
+	s.observers.Range(func(key, value interface{}) bool {
+		o := value.(*observer)
+		if o.addr == req.Meta.RemoteAddr && o.lastMid == req.MessageID {
+			s.observers.Delete(key)
+			logDebug(req, nil, "observer removed by reset")
+			return false
+		}
+		return true
+	})
+}
+
+// Observers returns the number of endpoints observing path.
+func (s *Server) Observers(path string) int {
+	count := 0
+	s.eachObserver(path, func(key string, o *observer) {
+		count++
+	})
+	return count
+}
+
+// Notify sends payload as a 2.05 Content notification to every observer of
+// path and returns the number of observers notified.
+func (s *Server) Notify(path string, payload []byte, contentFormat MediaType) int {
+	count := 0
+	s.eachObserver(path, func(key string, o *observer) {
+		if !s.beginExchange() {
+			return
+		}
+		rsp := NewMessage().WithCode(RspCodeContent).WithContentFormat(contentFormat).WithPayload(payload)
+		go func() {
+			defer s.endExchange()
+			s.notify(key, o, rsp)
+		}()
+		count++
+	})
+	return count
+}
+
+// Changed runs the route of path again for every observer of path, with the
+// request that registered the observer, and sends the result as a
+// notification. It returns the number of observers notified.
+func (s *Server) Changed(path string) int {
+	count := 0
+	s.eachObserver(path, func(key string, o *observer) {
+		req := *o.req
+		req.PathVars = nil
+		req.ctx = s.ctx
+		callback := chain(s.middleware, s.matchRoutes(&req))
+		if callback == nil || !s.beginExchange() {
+			return
+		}
+		go func() {
+			defer s.endExchange()
+			rsp := callRoute(callback, &req)
+			if rsp != nil {
+				s.notify(key, o, rsp)
+			}
+		}()
+		count++
+	})
+	return count
+}
+
+func (s *Server) eachObserver(path string, f func(key string, o *observer)) {
+	for len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+	s.observers.Range(func(key, value interface{}) bool {
+		o := value.(*observer)
+		if o.path == path {
+			f(key.(string), o)
+		}
+		return true
+	})
+}
+
+func (s *Server) notify(key string, o *observer, rsp *Message) {
+	msg := &Message{
+		Code:    rsp.Code,
+		Token:   o.req.Token,
+		Payload: rsp.Payload,
+		opts:    append(options{}, rsp.opts...).Minus(OptObserve),
+	}
+	if o.req.oscore != nil {
+		var err error
+		if msg, err = o.req.oscore.protectNotification(msg); err != nil {
+			logError(o.req, err, "coap: error protecting oscore notification")
+			return
+		}
+	}
+
+	so := s.NewOptions()
+	if o.req.Meta.BlockSize != 0 {
+		so.BlockSize = o.req.Meta.BlockSize
+	}
+	msg.Meta.BlockSize = so.BlockSize
+	msg.Meta.MaxMessageSize = o.req.Meta.MaxMessageSize
+	if msg.RequiresBlockwise() {
+		// the observer retrieves the remaining blocks with plain GETs, which
+		// are answered with piggybacked responses
+		msg.Type = TypeAcknowledgement
+		s.blockCachePut(msg, o.req.getBlockKey())
+		first, err := s.blockCacheGet(o.req, 0, so.BlockSize)
+		if err != nil {
+			logError(o.req, err, "coap: error getting first block2 of notification")
+			return
+		}
+		msg = first
+	}
+
+	o.mux.Lock()
+	o.seq = (o.seq + 1) & 0xffffff
+	msg.WithOption(OptObserve, o.seq, true)
+	msg.Type = TypeNonConfirmable
+	if o.typ == TypeConfirmable || time.Since(o.lastCon) > s.config.ObserveConfirmableInterval {
+		msg.Type = TypeConfirmable
+		o.lastCon = time.Now()
+	}
+	msg.MessageID = s.GetNextMsgId()
+	o.lastMid = msg.MessageID
+	o.mux.Unlock()
+
+	if rsp.IsSuccess() {
+		logDebug(msg, nil, "sending notification")
+	} else {
+		// an error response ends the observation (RFC 7641 section 3.2)
+		s.observers.CompareAndDelete(key, o)
+	}
+
+	_, err := s.send(s.ctx, o.addr, msg, so)
+	if err != nil {
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrReset) {
+			// the observer is no longer interested (RFC 7641 section 4.5)
+			s.observers.CompareAndDelete(key, o)
+			logDebug(msg, err, "observer removed")
+		} else {
+			logWarn(msg, err, "coap: error sending notification")
+		}
+	}
+}
+
+// optionUint returns the value of a uint option in either its parsed or its
+// constructed form.
+func optionUint(v interface{}) uint32 {
+	switch i := v.(type) {
+	case uint32:
+		return i
+	case int:
+		return uint32(i)
+	case uint:
+		return uint32(i)
+	case uint16:
+		return uint32(i)
+	case int32:
+		return uint32(i)
+	case MediaType:
+		return uint32(i)
+	case []byte:
+		return decodeInt(i)
+	}
+	return 0
+}
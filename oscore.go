@@ -0,0 +1,579 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	"github.com/qwerty-iot/dtls/v2"
+)
+
+// OSCORE uses AES-CCM-16-64-128 and HKDF SHA-256 (RFC 8613 section 3.2).
+const (
+	oscoreAlgAead      = 10
+	oscoreKeyLen       = 16
+	oscoreNonceLen     = 13
+	oscoreTagLen       = 8
+	oscoreMaxIDLen     = oscoreNonceLen - 6
+	oscoreMaxSeq       = 1<<40 - 1
+	oscoreReplayWindow = 32
+	// oscoreSaveInterval is how far ahead of the sequence numbers in use the
+	// state passed to SaveState is
+	oscoreSaveInterval = 64
+)
+
+// OscoreContext is an OSCORE security context (RFC 8613 section 3) shared
+// with a single peer, see Server.AddOscoreContext.
+type OscoreContext struct {
+	SenderID    []byte
+	RecipientID []byte
+	IDContext   []byte
+	// SaveState, when set, is called before the context uses a sequence
+	// number beyond the state it saved last. The state is to be persisted and
+	// passed to Restore when the context is derived again from the same
+	// master secret, e.g. after a restart. An error drops the message being
+	// protected or verified. SaveState must not use the context.
+	SaveState func(state OscoreState) error
+
+	senderAead    dtls.CCM
+	recipientAead dtls.CCM
+	commonIV      []byte
+
+	mux    sync.Mutex
+	seq    uint64
+	replay oscoreReplay
+	saved  OscoreState
+}
+
+// OscoreState is what a security context derived again from the same master
+// secret must resume from: reusing a sender sequence number reuses a nonce
+// under the same key, and a fresh replay window accepts old messages again
+// (RFC 8613 appendix B.1).
+type OscoreState struct {
+	// SenderSequence is the lowest sender sequence number not used yet.
+	SenderSequence uint64
+	// RecipientSequence is one above the highest sequence number that may
+	// have been received from the peer, lower ones are rejected as replays.
+	RecipientSequence uint64
+}
+
+// oscoreReplay is the replay window of a recipient (RFC 8613 section 7.4).
+type oscoreReplay struct {
+	init    bool
+	highest uint64
+	seen    uint32
+}
+
+// oscoreRequest holds what the response to a protected request is protected
+// and verified with.
+type oscoreRequest struct {
+	ctx   *OscoreContext
+	kid   []byte
+	piv   []byte
+	nonce []byte
+	// block key of the request before it was decrypted
+	blockKey string
+}
+
+type oscoreKey struct {
+	idContext string
+	id        string
+}
+
+// NewOscoreContext derives a security context from the master secret and
+// salt (RFC 8613 section 3.2). masterSalt and idContext may be nil. A context
+// derived from a master secret that was used before must Restore the state
+// the earlier context saved, see SaveState.
+func NewOscoreContext(masterSecret, masterSalt, senderID, recipientID, idContext []byte) (*OscoreContext, error) {
+	if len(senderID) > oscoreMaxIDLen || len(recipientID) > oscoreMaxIDLen {
+		return nil, ErrOscoreInvalidID
+	}
+	c := &OscoreContext{
+		SenderID:    append([]byte{}, senderID...),
+		RecipientID: append([]byte{}, recipientID...),
+		IDContext:   idContext,
+	}
+	prk := hkdfExtract(masterSalt, masterSecret)
+	var err error
+	if c.senderAead, err = oscoreAead(hkdfExpand(prk, oscoreInfo(c.SenderID, idContext, "Key", oscoreKeyLen), oscoreKeyLen)); err != nil {
+		return nil, err
+	}
+	if c.recipientAead, err = oscoreAead(hkdfExpand(prk, oscoreInfo(c.RecipientID, idContext, "Key", oscoreKeyLen), oscoreKeyLen)); err != nil {
+		return nil, err
+	}
+	c.commonIV = hkdfExpand(prk, oscoreInfo([]byte{}, idContext, "IV", oscoreNonceLen), oscoreNonceLen)
+	return c, nil
+}
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func oscoreInfo(id, idContext []byte, typ string, length int) []byte {
+	b := cborArray(nil, 5)
+	b = cborBytes(b, id)
+	b = cborBytesOrNull(b, idContext)
+	b = cborInt(b, oscoreAlgAead)
+	b = cborText(b, typ)
+	return cborInt(b, int64(length))
+}
+
+func oscoreAead(key []byte) (dtls.CCM, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return dtls.NewCCM(block, oscoreTagLen, oscoreNonceLen)
+}
+
+// nonce computes the AEAD nonce from the ID of the sender of the partial IV
+// (RFC 8613 section 5.2).
+func (c *OscoreContext) nonce(id, piv []byte) []byte {
+	n := make([]byte, oscoreNonceLen)
+	n[0] = byte(len(id))
+	copy(n[1+oscoreMaxIDLen-len(id):], id)
+	copy(n[oscoreNonceLen-len(piv):], piv)
+	for i := range n {
+		n[i] ^= c.commonIV[i]
+	}
+	return n
+}
+
+// oscoreAAD is the additional authenticated data, the Enc_structure over the
+// external_aad of the request (RFC 8613 section 5.4).
+func oscoreAAD(kid, piv []byte) []byte {
+	ext := cborArray(nil, 5)
+	ext = cborInt(ext, 1)
+	ext = cborArray(ext, 1)
+	ext = cborInt(ext, oscoreAlgAead)
+	ext = cborBytes(ext, kid)
+	ext = cborBytes(ext, piv)
+	ext = cborBytes(ext, nil)
+
+	aad := cborArray(nil, 3)
+	aad = cborText(aad, "Encrypt0")
+	aad = cborBytes(aad, nil)
+	return cborBytes(aad, ext)
+}
+
+func oscorePiv(seq uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, seq)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func oscoreSeq(piv []byte) uint64 {
+	var seq uint64
+	for _, b := range piv {
+		seq = seq<<8 | uint64(b)
+	}
+	return seq
+}
+
+// State returns the current state of the context, which is safe to resume
+// from with Restore once the context is no longer used.
+func (c *OscoreContext) State() OscoreState {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	state := OscoreState{SenderSequence: c.seq}
+	if c.replay.init {
+		state.RecipientSequence = c.replay.highest + 1
+	}
+	return state
+}
+
+// Restore continues the context from a state persisted by SaveState or
+// returned by State, it must be called before the context is used.
+func (c *OscoreContext) Restore(state OscoreState) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.seq = state.SenderSequence
+	c.replay = oscoreReplay{}
+	if state.RecipientSequence > 0 {
+		c.replay = oscoreReplay{init: true, highest: state.RecipientSequence - 1, seen: 1<<oscoreReplayWindow - 1}
+	}
+	c.saved = state
+}
+
+// save passes state to SaveState and keeps it as the state saved last, c.mux
+// is held.
+func (c *OscoreContext) save(state OscoreState) error {
+	if err := c.SaveState(state); err != nil {
+		return err
+	}
+	c.saved = state
+	return nil
+}
+
+// replayCheck returns false if seq was already received or is too old for
+// the window, otherwise it is recorded.
+func (c *OscoreContext) replayCheck(seq uint64) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.SaveState != nil && seq >= c.saved.RecipientSequence {
+		state := c.saved
+		state.RecipientSequence = seq + 1 + oscoreSaveInterval
+		if err := c.save(state); err != nil {
+			logWarn(nil, err, "coap: error saving oscore state")
+			return false
+		}
+	}
+	w := &c.replay
+	switch {
+	case !w.init:
+		w.init, w.highest, w.seen = true, seq, 1
+	case seq > w.highest:
+		if shift := seq - w.highest; shift >= oscoreReplayWindow {
+			w.seen = 1
+		} else {
+			w.seen = w.seen<<shift | 1
+		}
+		w.highest = seq
+	default:
+		diff := w.highest - seq
+		if diff >= oscoreReplayWindow || w.seen&(1<<diff) != 0 {
+			return false
+		}
+		w.seen |= 1 << diff
+	}
+	return true
+}
+
+// oscoreOption is the value of the OSCORE option (RFC 8613 section 6.1).
+type oscoreOption struct {
+	piv []byte
+	// kid and kidContext are nil when absent
+	kid        []byte
+	kidContext []byte
+}
+
+func (o *oscoreOption) encode() []byte {
+	if len(o.piv) == 0 && o.kid == nil && o.kidContext == nil {
+		return []byte{}
+	}
+	b := []byte{byte(len(o.piv))}
+	b = append(b, o.piv...)
+	if o.kidContext != nil {
+		b[0] |= 0x10
+		b = append(b, byte(len(o.kidContext)))
+		b = append(b, o.kidContext...)
+	}
+	if o.kid != nil {
+		b[0] |= 0x08
+		b = append(b, o.kid...)
+	}
+	return b
+}
+
+func parseOscoreOption(v []byte) (*oscoreOption, error) {
+	o := &oscoreOption{}
+	if len(v) == 0 {
+		return o, nil
+	}
+	flags := v[0]
+	v = v[1:]
+	n := int(flags & 0x07)
+	if flags&0xe0 != 0 || n > 5 || len(v) < n {
+		return nil, ErrOscoreBadOption
+	}
+	o.piv, v = v[:n], v[n:]
+	if flags&0x10 != 0 {
+		if len(v) < 1 || len(v) < 1+int(v[0]) {
+			return nil, ErrOscoreBadOption
+		}
+		o.kidContext, v = v[1:1+int(v[0])], v[1+int(v[0]):]
+	}
+	if flags&0x08 != 0 {
+		o.kid = v
+	} else if len(v) > 0 {
+		return nil, ErrOscoreBadOption
+	}
+	return o, nil
+}
+
+// oscoreOuter reports whether an option is left unprotected for proxies and
+// the transport, all others are encrypted (RFC 8613 section 4.1).
+func oscoreOuter(id OptionID) bool {
+	switch id {
+	case OptURIHost, OptURIPort, OptProxyURI, OptProxyScheme, OptObserve, OptOscore,
+		OptBlock1, OptBlock2, OptSize1, OptSize2:
+		return true
+	}
+	return false
+}
+
+// oscoreSeal returns the protected form of msg, with outer code and the
+// inner code, options and payload encrypted in the payload.
+func oscoreSeal(msg *Message, code COAPCode, optValue []byte, aead dtls.CCM, nonce, aad []byte) (*Message, error) {
+	inner := &Message{Code: msg.Code, Payload: msg.Payload}
+	out := &Message{Type: msg.Type, Code: code, MessageID: msg.MessageID, Token: msg.Token, Meta: msg.Meta}
+	for _, o := range msg.opts {
+		if oscoreOuter(o.ID) {
+			out.opts = append(out.opts, o)
+		} else {
+			inner.opts = append(inner.opts, o)
+		}
+	}
+	out.opts = append(out.opts, option{ID: OptOscore, Value: optValue})
+
+	pt := bytes.Buffer{}
+	pt.WriteByte(byte(inner.Code))
+	if err := inner.marshalOptions(&pt); err != nil {
+		return nil, err
+	}
+	pt.Write(inner.Payload)
+	out.Payload = aead.Seal(nil, nonce, pt.Bytes(), aad)
+	return out, nil
+}
+
+// oscoreOpen decrypts msg in place, restoring its inner code, options and
+// payload.
+func oscoreOpen(msg *Message, aead dtls.CCM, nonce, aad []byte) error {
+	pt, err := aead.Open(nil, nonce, msg.Payload, aad)
+	if err != nil || len(pt) == 0 {
+		return ErrOscoreDecrypt
+	}
+	inner := Message{Code: COAPCode(pt[0])}
+	if err := inner.unmarshalOptions(pt[1:]); err != nil {
+		return ErrOscoreDecrypt
+	}
+	opts := options{}
+	for _, o := range msg.opts {
+		if o.ID != OptOscore && oscoreOuter(o.ID) {
+			opts = append(opts, o)
+		}
+	}
+	for _, o := range inner.opts {
+		if !oscoreOuter(o.ID) {
+			opts = append(opts, o)
+		}
+	}
+	msg.Code = inner.Code
+	msg.opts = opts
+	msg.Payload = inner.Payload
+	msg.queryVars = nil
+	return nil
+}
+
+// nextPiv returns the next sender sequence number as partial IV.
+func (c *OscoreContext) nextPiv() ([]byte, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.seq > oscoreMaxSeq {
+		return nil, ErrOscoreSequenceExhausted
+	}
+	if c.SaveState != nil && c.seq >= c.saved.SenderSequence {
+		state := c.saved
+		state.SenderSequence = c.seq + oscoreSaveInterval
+		if err := c.save(state); err != nil {
+			return nil, err
+		}
+	}
+	piv := oscorePiv(c.seq)
+	c.seq++
+	return piv, nil
+}
+
+// protectRequest returns the protected form of the request msg, with the
+// next sender sequence number as partial IV.
+func (c *OscoreContext) protectRequest(msg *Message) (*Message, *oscoreRequest, error) {
+	piv, err := c.nextPiv()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oreq := &oscoreRequest{ctx: c, kid: c.SenderID, piv: piv, nonce: c.nonce(c.SenderID, piv)}
+	opt := &oscoreOption{piv: piv, kid: c.SenderID, kidContext: c.IDContext}
+	code := CodePost
+	if msg.Option(OptObserve) != nil {
+		code = CodeFetch
+	}
+	out, err := oscoreSeal(msg, code, opt.encode(), c.senderAead, oreq.nonce, oscoreAAD(oreq.kid, oreq.piv))
+	if err != nil {
+		return nil, nil, err
+	}
+	return out, oreq, nil
+}
+
+// unprotectResponse verifies and decrypts the response in place. Responses
+// without the OSCORE option are only accepted for errors, which the peer
+// returns when it cannot verify the request.
+func (r *oscoreRequest) unprotectResponse(rsp *Message) error {
+	v, ok := rsp.Option(OptOscore).([]byte)
+	if !ok {
+		if rsp.Code >= RspCodeBadRequest {
+			return nil
+		}
+		return ErrOscoreUnprotected
+	}
+	opt, err := parseOscoreOption(v)
+	if err != nil {
+		return err
+	}
+	nonce := r.nonce
+	if len(opt.piv) > 0 {
+		nonce = r.ctx.nonce(r.ctx.RecipientID, opt.piv)
+	}
+	if err := oscoreOpen(rsp, r.ctx.recipientAead, nonce, oscoreAAD(r.kid, r.piv)); err != nil {
+		return err
+	}
+	if len(opt.piv) > 0 && !r.ctx.replayCheck(oscoreSeq(opt.piv)) {
+		return ErrOscoreReplay
+	}
+	return nil
+}
+
+// protectResponse returns the protected form of the response to the request,
+// reusing the nonce of the request.
+func (r *oscoreRequest) protectResponse(rsp *Message) (*Message, error) {
+	if rsp.Option(OptObserve) != nil {
+		return r.protectNotification(rsp)
+	}
+	return oscoreSeal(rsp, RspCodeChanged, []byte{}, r.ctx.senderAead, r.nonce, oscoreAAD(r.kid, r.piv))
+}
+
+// protectNotification returns the protected form of a notification of the
+// observation registered by the request, each with a partial IV of its own
+// (RFC 8613 section 4.1.3.5.2).
+func (r *oscoreRequest) protectNotification(rsp *Message) (*Message, error) {
+	piv, err := r.ctx.nextPiv()
+	if err != nil {
+		return nil, err
+	}
+	opt := &oscoreOption{piv: piv}
+	return oscoreSeal(rsp, RspCodeContent, opt.encode(), r.ctx.senderAead, r.ctx.nonce(r.ctx.SenderID, piv), oscoreAAD(r.kid, r.piv))
+}
+
+// OscoreContext returns the security context a received request was
+// protected with, nil if it was received without OSCORE.
+func (m *Message) OscoreContext() *OscoreContext {
+	if m.oscore == nil {
+		return nil
+	}
+	return m.oscore.ctx
+}
+
+// AddOscoreContext registers oc with the Server. Requests sent to addr, as
+// given to Send, are protected with it, and requests received with its
+// recipient ID are verified with it. addr may be empty for a context that
+// only answers requests.
+func (s *Server) AddOscoreContext(addr string, oc *OscoreContext) {
+	s.oscoreMux.Lock()
+	defer s.oscoreMux.Unlock()
+	if addr != "" {
+		if old := s.oscorePeers[addr]; old != nil && old != oc {
+			// a new context replaces the one of the peer, e.g. after EDHOC
+			key := oscoreKey{idContext: string(old.IDContext), id: string(old.RecipientID)}
+			if s.oscoreRecipients[key] == old {
+				delete(s.oscoreRecipients, key)
+			}
+		}
+		s.oscorePeers[addr] = oc
+	}
+	s.oscoreRecipients[oscoreKey{idContext: string(oc.IDContext), id: string(oc.RecipientID)}] = oc
+}
+
+// RemoveOscoreContext forgets oc.
+func (s *Server) RemoveOscoreContext(oc *OscoreContext) {
+	s.oscoreMux.Lock()
+	defer s.oscoreMux.Unlock()
+	for addr, c := range s.oscorePeers {
+		if c == oc {
+			delete(s.oscorePeers, addr)
+		}
+	}
+	for key, c := range s.oscoreRecipients {
+		if c == oc {
+			delete(s.oscoreRecipients, key)
+		}
+	}
+}
+
+func (s *Server) oscorePeer(addr string) *OscoreContext {
+	s.oscoreMux.RLock()
+	defer s.oscoreMux.RUnlock()
+	return s.oscorePeers[addr]
+}
+
+// sendOscore sends msg protected with oc and returns the decrypted response.
+func (s *Server) sendOscore(ctx context.Context, addr string, msg *Message, oc *OscoreContext, options *SendOptions) (*Message, error) {
+	protected, oreq, err := oc.protectRequest(msg)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := s.sendContext(ctx, addr, protected, options)
+	msg.Token = protected.Token
+	msg.MessageID = protected.MessageID
+	msg.Meta = protected.Meta
+	msg.oscoreSent = oreq
+	if err != nil || rsp == nil {
+		return rsp, err
+	}
+	if err := oreq.unprotectResponse(rsp); err != nil {
+		logWarn(rsp, err, "coap: error verifying oscore response")
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// oscoreUnprotect verifies and decrypts the request in place, the error
+// response is returned unprotected if it cannot (RFC 8613 section 8.2).
+func (s *Server) oscoreUnprotect(req *Message) *Message {
+	fail := func(code COAPCode, diag string, err error) *Message {
+		logWarn(req, err, "coap: error verifying oscore request")
+		rsp := req.MakeReply(code, []byte(diag))
+		if req.Type == TypeNonConfirmable {
+			rsp.Type = TypeNonConfirmable
+		}
+		return rsp
+	}
+
+	v, _ := req.Option(OptOscore).([]byte)
+	opt, err := parseOscoreOption(v)
+	if err != nil || opt.kid == nil || len(opt.piv) == 0 {
+		return fail(RspCodeBadOption, "", ErrOscoreBadOption)
+	}
+
+	s.oscoreMux.RLock()
+	c := s.oscoreRecipients[oscoreKey{idContext: string(opt.kidContext), id: string(opt.kid)}]
+	s.oscoreMux.RUnlock()
+	if c == nil {
+		return fail(RspCodeUnauthorized, "Security context not found", ErrOscoreContextNotFound)
+	}
+
+	blockKey := req.getBlockKey()
+	nonce := c.nonce(opt.kid, opt.piv)
+	if err := oscoreOpen(req, c.recipientAead, nonce, oscoreAAD(opt.kid, opt.piv)); err != nil {
+		return fail(RspCodeBadRequest, "Decryption failed", err)
+	}
+	if !c.replayCheck(oscoreSeq(opt.piv)) {
+		return fail(RspCodeUnauthorized, "Replay detected", ErrOscoreReplay)
+	}
+	req.oscore = &oscoreRequest{ctx: c, kid: opt.kid, piv: opt.piv, nonce: nonce, blockKey: blockKey}
+	return nil
+}
@@ -0,0 +1,329 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qwerty-iot/dtls/v2"
+)
+
+func TestOscoreRestore(t *testing.T) {
+	secret := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	var saved []OscoreState
+	c, err := NewOscoreContext(secret, nil, []byte{1}, []byte{2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SaveState = func(state OscoreState) error {
+		saved = append(saved, state)
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.nextPiv(); err != nil {
+			t.Fatal(err)
+		}
+		if !c.replayCheck(uint64(i)) {
+			t.Fatalf("sequence number %d rejected", i)
+		}
+	}
+	if len(saved) != 2 || saved[1].SenderSequence <= 2 || saved[1].RecipientSequence <= 3 {
+		t.Fatalf("unexpected saved states %+v", saved)
+	}
+
+	// a restarted process derives the context again
+	state := saved[len(saved)-1]
+	c, _ = NewOscoreContext(secret, nil, []byte{1}, []byte{2}, nil)
+	c.Restore(state)
+	piv, err := c.nextPiv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq := oscoreSeq(piv); seq < state.SenderSequence {
+		t.Fatalf("sender sequence number %d reused, saved %d", seq, state.SenderSequence)
+	}
+	for seq := uint64(0); seq < state.RecipientSequence; seq++ {
+		if c.replayCheck(seq) {
+			t.Fatalf("replay of %d accepted after restore", seq)
+		}
+	}
+	if !c.replayCheck(state.RecipientSequence) {
+		t.Fatal("fresh sequence number rejected after restore")
+	}
+
+	// a state that cannot be saved stops the context
+	failed := errors.New("disk full")
+	c, _ = NewOscoreContext(secret, nil, []byte{1}, []byte{2}, nil)
+	c.SaveState = func(state OscoreState) error { return failed }
+	if _, err := c.nextPiv(); err != failed {
+		t.Fatalf("expected %v, got %v", failed, err)
+	}
+	if c.replayCheck(0) {
+		t.Fatal("sequence number accepted without saved state")
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestOscoreKeyDerivation checks the contexts of the test vectors of RFC 8613
+// appendix C.1 to C.3.
+func TestOscoreKeyDerivation(t *testing.T) {
+	secret := "0102030405060708090a0b0c0d0e0f10"
+	tests := []struct {
+		name                    string
+		salt, sender, recipient string
+		idContext               string
+		senderKey, recipientKey string
+		commonIV                string
+		senderNonce             string
+		recipientNonce          string
+	}{
+		{"C.1.1 client", "9e7ca92223786340", "", "01", "",
+			"f0910ed7295e6ad4b54fc793154302ff", "ffb14e093c94c9cac9471648b4f98710",
+			"4622d4dd6d944168eefb54987c", "4622d4dd6d944168eefb54987c", "4722d4dd6d944169eefb54987c"},
+		{"C.1.2 server", "9e7ca92223786340", "01", "", "",
+			"ffb14e093c94c9cac9471648b4f98710", "f0910ed7295e6ad4b54fc793154302ff",
+			"4622d4dd6d944168eefb54987c", "4722d4dd6d944169eefb54987c", "4622d4dd6d944168eefb54987c"},
+		{"C.2.1 client", "", "00", "01", "",
+			"321b26943253c7ffb6003b0b64d74041", "e57b5635815177cd679ab4bcec9d7dda",
+			"be35ae297d2dace910c52e99f9", "bf35ae297d2dace910c52e99f9", "bf35ae297d2dace810c52e99f9"},
+		{"C.3.1 client", "9e7ca92223786340", "", "01", "37cbf3210017a2d3",
+			"af2a1300a5e95788b356336eeecd2b92", "e39a0c7c77b43f03b4b39ab9a268699f",
+			"2ca58fb85ff1b81c0b7181b85e", "2ca58fb85ff1b81c0b7181b85e", "2da58fb85ff1b81d0b7181b85e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var salt, idContext []byte
+			if tt.salt != "" {
+				salt = mustHex(t, tt.salt)
+			}
+			if tt.idContext != "" {
+				idContext = mustHex(t, tt.idContext)
+			}
+			c, err := NewOscoreContext(mustHex(t, secret), salt, mustHex(t, tt.sender), mustHex(t, tt.recipient), idContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(c.commonIV, mustHex(t, tt.commonIV)) {
+				t.Errorf("common iv %x", c.commonIV)
+			}
+			if n := c.nonce(c.SenderID, []byte{0}); !bytes.Equal(n, mustHex(t, tt.senderNonce)) {
+				t.Errorf("sender nonce %x", n)
+			}
+			if n := c.nonce(c.RecipientID, []byte{0}); !bytes.Equal(n, mustHex(t, tt.recipientNonce)) {
+				t.Errorf("recipient nonce %x", n)
+			}
+			// the keys are only held as ciphers, compare what they seal
+			for _, k := range []struct {
+				name string
+				aead dtls.CCM
+				key  string
+			}{{"sender", c.senderAead, tt.senderKey}, {"recipient", c.recipientAead, tt.recipientKey}} {
+				want, err := oscoreAead(mustHex(t, k.key))
+				if err != nil {
+					t.Fatal(err)
+				}
+				nonce := mustHex(t, tt.commonIV)
+				if !bytes.Equal(k.aead.Seal(nil, nonce, []byte("plaintext"), nil), want.Seal(nil, nonce, []byte("plaintext"), nil)) {
+					t.Errorf("%s key differs from %s", k.name, k.key)
+				}
+			}
+		})
+	}
+}
+
+// TestOscoreVectors checks the protected request of RFC 8613 appendix C.4 and
+// the protected response of appendix C.7.
+func TestOscoreVectors(t *testing.T) {
+	secret, salt := mustHex(t, "0102030405060708090a0b0c0d0e0f10"), mustHex(t, "9e7ca92223786340")
+	client, _ := NewOscoreContext(secret, salt, nil, []byte{1}, nil)
+	server, _ := NewOscoreContext(secret, salt, []byte{1}, nil, nil)
+	client.Restore(OscoreState{SenderSequence: 20})
+
+	req, err := parseMessage(mustHex(t, "44015d1f00003974396c6f63616c686f737483747631"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected, oreq, err := client.protectRequest(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oreq.nonce, mustHex(t, "4622d4dd6d944168eefb549868")) {
+		t.Errorf("request nonce %x", oreq.nonce)
+	}
+	data, err := protected.marshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "44025d1f00003974396c6f63616c686f7374620914ff612f1092f1776f1c1668b3825e"); !bytes.Equal(data, want) {
+		t.Fatalf("protected request\n got %x\nwant %x", data, want)
+	}
+
+	rsp, err := parseMessage(mustHex(t, "64455d1f00003974ff48656c6c6f20576f726c6421"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sreq := &oscoreRequest{ctx: server, kid: oreq.kid, piv: oreq.piv, nonce: oreq.nonce}
+	prsp, err := sreq.protectResponse(&rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = prsp.marshalBinary(); !bytes.Equal(data, mustHex(t, "64445d1f0000397490ffdbaad1e9a7e7b2a813d3c31524378303cdafae119106")) {
+		t.Fatalf("protected response %x", data)
+	}
+	if err := oreq.unprotectResponse(prsp); err != nil || prsp.Code != RspCodeContent || string(prsp.Payload) != "Hello World!" {
+		t.Fatalf("unprotected response %v %q %v", prsp.Code, prsp.Payload, err)
+	}
+}
+
+// oscorePair returns a server with a context for the client ID 0x01 and a
+// route that answers with the inner request, and a client holding the matching
+// context for the server.
+func oscorePair(t *testing.T) (client, server *Server, addr string, cc *OscoreContext) {
+	secret, salt := mustHex(t, "0102030405060708090a0b0c0d0e0f10"), mustHex(t, "9e7ca92223786340")
+	server = newTestServer(t, nil)
+	sc, _ := NewOscoreContext(secret, salt, nil, []byte{1}, nil)
+	server.AddOscoreContext("", sc)
+	server.AddRoute("secret", func(req *Message) *Message {
+		if req.OscoreContext() != sc {
+			return req.MakeReply(RspCodeUnauthorized, nil)
+		}
+		return req.MakeReply(RspCodeContent, append([]byte(req.Code.String()+" "), req.Payload...))
+	})
+	client = newTestServer(t, nil)
+	addr = server.udpListener.LocalAddr()
+	cc, _ = NewOscoreContext(secret, salt, []byte{1}, nil, nil)
+	client.AddOscoreContext(addr, cc)
+	return client, server, addr, cc
+}
+
+func TestOscoreRoundTrip(t *testing.T) {
+	client, _, addr, _ := oscorePair(t)
+	req := newTestRequest(TypeConfirmable, CodePut, "secret")
+	req.Payload = []byte("hello")
+	rsp, err := client.Send(addr, req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != RspCodeContent || string(rsp.Payload) != CodePut.String()+" hello" {
+		t.Fatalf("unexpected response %v %q", rsp.Code, rsp.Payload)
+	}
+	if req.Option(OptOscore) != nil {
+		t.Fatal("request passed to Send was modified")
+	}
+}
+
+func TestOscoreReplay(t *testing.T) {
+	client, _, addr, cc := oscorePair(t)
+	protected, oreq, err := cc.protectRequest(newTestRequest(TypeConfirmable, CodeGet, "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := client.Send(addr, protected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oreq.unprotectResponse(rsp); err != nil || rsp.Code != RspCodeContent {
+		t.Fatalf("unexpected response %v %v", rsp.Code, err)
+	}
+
+	// the same protected request again, in a message of its own
+	protected.MessageID = 0
+	rsp, err = client.Send(addr, protected, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != RspCodeUnauthorized || string(rsp.Payload) != "Replay detected" {
+		t.Fatalf("replay answered with %v %q", rsp.Code, rsp.Payload)
+	}
+}
+
+func TestOscoreUnknownKid(t *testing.T) {
+	client, _, addr, _ := oscorePair(t)
+	unknown, _ := NewOscoreContext(mustHex(t, "0102030405060708090a0b0c0d0e0f10"), nil, []byte{7}, nil, nil)
+	client.AddOscoreContext(addr, unknown)
+	rsp, err := client.Send(addr, newTestRequest(TypeConfirmable, CodeGet, "secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Code != RspCodeUnauthorized || string(rsp.Payload) != "Security context not found" {
+		t.Fatalf("unknown kid answered with %v %q", rsp.Code, rsp.Payload)
+	}
+}
+
+func TestOscoreNotification(t *testing.T) {
+	client, server, addr, _ := oscorePair(t)
+	server.AddRoute("temp", func(req *Message) *Message {
+		return req.MakeReply(RspCodeContent, []byte("20"))
+	})
+	values := make(chan string, 4)
+	_, err := client.Observe(addr, CodeGet, "temp", nil, None, func(rsp *Message, arg interface{}) error {
+		values <- string(rsp.Payload)
+		return nil
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"20", "21", "22"} {
+		if v != "20" {
+			server.Notify("temp", []byte(v), TextPlain)
+		}
+		select {
+		case got := <-values:
+			if got != v {
+				t.Fatalf("expected %q, got %q", v, got)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("notification %q not received", v)
+		}
+	}
+}
+
+// TestOscoreConcurrentBlock2 fetches two large protected responses at once,
+// their remaining blocks are requested with the same outer code and path.
+func TestOscoreConcurrentBlock2(t *testing.T) {
+	client, server, addr, _ := oscorePair(t)
+	var both sync.WaitGroup
+	both.Add(2)
+	for _, name := range []string{"a", "b"} {
+		payload := bytes.Repeat([]byte(name), 3000)
+		server.AddRoute(name, func(req *Message) *Message {
+			// both responses are cached before either transfer goes on
+			both.Done()
+			both.Wait()
+			rsp := req.MakeReply(RspCodeContent, payload)
+			rsp.Meta.BlockSize = 512
+			return rsp
+		})
+	}
+	errs := make(chan error, 2)
+	for _, name := range []string{"a", "b"} {
+		go func(name string) {
+			rsp, err := client.Send(addr, newTestRequest(TypeConfirmable, CodeGet, name), client.NewOptions().WithNStart(2))
+			if err == nil && !bytes.Equal(rsp.Payload, bytes.Repeat([]byte(name), 3000)) {
+				err = fmt.Errorf("%s received %d bytes starting with %q", name, len(rsp.Payload), rsp.Payload[:1])
+			}
+			errs <- err
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
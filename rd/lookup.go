@@ -0,0 +1,183 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qwerty-iot/coap"
+	"github.com/qwerty-iot/coap/linkformat"
+)
+
+// lookupEndpoints answers the endpoint lookup interface, an endpoint matches
+// a filter through its registration parameters or any of its links (RFC 9176
+// section 7.1).
+func (d *Directory) lookupEndpoints(req *coap.Message) *coap.Message {
+	filters, page, count, err := lookupParams(req)
+	if err != nil {
+		return badRequest(req, err.Error())
+	}
+	regs, err := d.Registrations()
+	if err != nil {
+		return req.MakeReply(coap.RspCodeInternalServerError, nil)
+	}
+
+	var lf linkformat.LinkFormat
+	for _, reg := range regs {
+		ep := reg.endpointLink()
+		if matchAll(filters, func(name string, value string) bool {
+			if ep.Matches(name, value) {
+				return true
+			}
+			for _, l := range reg.Links {
+				if l.Matches(name, value) {
+					return true
+				}
+			}
+			return false
+		}) {
+			lf = append(lf, ep)
+		}
+	}
+	return linkReply(req, paginate(lf, page, count))
+}
+
+// lookupResources answers the resource lookup interface with the links of
+// all registrations, resolved against their base (RFC 9176 section 7.1).
+func (d *Directory) lookupResources(req *coap.Message) *coap.Message {
+	filters, page, count, err := lookupParams(req)
+	if err != nil {
+		return badRequest(req, err.Error())
+	}
+	regs, err := d.Registrations()
+	if err != nil {
+		return req.MakeReply(coap.RspCodeInternalServerError, nil)
+	}
+
+	var lf linkformat.LinkFormat
+	for _, reg := range regs {
+		ep := reg.endpointLink()
+		for _, l := range reg.Links {
+			res := reg.resolve(l)
+			if matchAll(filters, func(name string, value string) bool {
+				return res.Matches(name, value) || (name != "href" && ep.Matches(name, value))
+			}) {
+				lf = append(lf, res)
+			}
+		}
+	}
+	return linkReply(req, paginate(lf, page, count))
+}
+
+// endpointLink returns the registration as listed by the endpoint lookup.
+func (r *Registration) endpointLink() linkformat.Link {
+	l := linkformat.NewLink(r.Path())
+	l.AddQuoted("base", r.Base)
+	l.AddQuoted("ep", r.Endpoint)
+	if len(r.Sector) != 0 {
+		l.AddQuoted("d", r.Sector)
+	}
+	if len(r.EndpointType) != 0 {
+		l.AddQuoted("et", r.EndpointType)
+	}
+	l.Add("lt", strconv.FormatInt(int64(r.Lifetime/time.Second), 10))
+	for _, k := range sortedKeys(r.Attrs) {
+		if len(r.Attrs[k]) == 0 {
+			l.AddFlag(k)
+		} else {
+			l.Add(k, r.Attrs[k])
+		}
+	}
+	l.Add("rt", "core.rd-ep")
+	return *l
+}
+
+// resolve returns l with its target and anchor made absolute against the
+// base of the registration, the anchor defaults to the base.
+func (r *Registration) resolve(l linkformat.Link) linkformat.Link {
+	res := linkformat.Link{Target: r.resolveURI(l.Target)}
+	anchor := r.Base
+	for _, a := range l.Attrs {
+		if a.Name == "anchor" {
+			anchor = r.resolveURI(a.Value)
+			continue
+		}
+		res.Attrs = append(res.Attrs, a)
+	}
+	res.AddQuoted("anchor", anchor)
+	return res
+}
+
+func (r *Registration) resolveURI(ref string) string {
+	if strings.Contains(ref, "://") {
+		return ref
+	}
+	if strings.HasPrefix(ref, "/") {
+		return r.Base + ref
+	}
+	return r.Base + "/" + ref
+}
+
+// lookupParams splits the lookup query into filters and the page and count
+// parameters, count is -1 if absent.
+func lookupParams(req *coap.Message) ([][2]string, int, int, error) {
+	var filters [][2]string
+	page, count := 0, -1
+	for _, p := range queryParams(req) {
+		switch p[0] {
+		case "page", "count":
+			v, err := strconv.Atoi(p[1])
+			if err != nil || v < 0 {
+				return nil, 0, 0, errInvalidParam(p[0])
+			}
+			if p[0] == "page" {
+				page = v
+			} else {
+				count = v
+			}
+		default:
+			filters = append(filters, p)
+		}
+	}
+	return filters, page, count, nil
+}
+
+func matchAll(filters [][2]string, match func(name string, value string) bool) bool {
+	for _, f := range filters {
+		if !match(f[0], f[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// paginate returns page number page of count links, page is ignored
+// without count (RFC 9176 section 7.1).
+func paginate(lf linkformat.LinkFormat, page int, count int) linkformat.LinkFormat {
+	if count < 0 {
+		return lf
+	}
+	start := page * count
+	if start >= len(lf) {
+		return nil
+	}
+	end := start + count
+	if end > len(lf) {
+		end = len(lf)
+	}
+	return lf[start:end]
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,345 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package rd implements a CoRE Resource Directory (RFC 9176) on the routes of
+// a coap.Server: endpoints register their links with POST /rd, keep the
+// registration alive with updates, and clients find endpoints and resources
+// through the lookup interfaces.
+package rd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qwerty-iot/coap"
+	"github.com/qwerty-iot/coap/linkformat"
+)
+
+const (
+	RegistrationPath   = "/rd"
+	EndpointLookupPath = "/rd-lookup/ep"
+	ResourceLookupPath = "/rd-lookup/res"
+)
+
+// DefaultLifetime is the registration lifetime when the lt parameter is
+// absent (RFC 9176 section 5).
+const DefaultLifetime = 90000 * time.Second
+
+// Directory is a Resource Directory mounted on a coap.Server.
+type Directory struct {
+	store Store
+	mux   sync.Mutex
+	// OnChange is called after a registration was created, updated, removed
+	// or expired, with reg nil when it was removed.
+	OnChange func(id string, reg *Registration)
+
+	shutdown chan struct{}
+	once     sync.Once
+}
+
+// Mount adds the registration and lookup routes to s and starts expiring
+// registrations. A nil store keeps the registrations in memory.
+func Mount(s *coap.Server, store Store) *Directory {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	d := &Directory{store: store, shutdown: make(chan struct{})}
+
+	rdLink := coap.LinkAttributes{ResourceType: []string{"core.rd"}, ContentFormat: []coap.MediaType{coap.AppLinkFormat}}
+	s.AddMethodRoute(coap.CodePost, RegistrationPath, d.register, coap.WithLink(rdLink))
+	s.AddMethodRoute(coap.CodeGet, RegistrationPath+"/{id}", d.registration)
+	s.AddMethodRoute(coap.CodePost, RegistrationPath+"/{id}", d.registration)
+	s.AddMethodRoute(coap.CodeDelete, RegistrationPath+"/{id}", d.registration)
+
+	epLink := coap.LinkAttributes{ResourceType: []string{"core.rd-lookup-ep"}, ContentFormat: []coap.MediaType{coap.AppLinkFormat}}
+	s.AddMethodRoute(coap.CodeGet, EndpointLookupPath, d.lookupEndpoints, coap.WithLink(epLink))
+	resLink := coap.LinkAttributes{ResourceType: []string{"core.rd-lookup-res"}, ContentFormat: []coap.MediaType{coap.AppLinkFormat}}
+	s.AddMethodRoute(coap.CodeGet, ResourceLookupPath, d.lookupResources, coap.WithLink(resLink))
+
+	go d.expire()
+	return d
+}
+
+// Close stops expiring registrations, the routes stay mounted.
+func (d *Directory) Close() {
+	d.once.Do(func() {
+		close(d.shutdown)
+	})
+}
+
+// Registrations returns the registrations that have not expired.
+func (d *Directory) Registrations() ([]*Registration, error) {
+	regs, err := d.store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var rv []*Registration
+	for _, reg := range regs {
+		if !reg.Expired(now) {
+			rv = append(rv, reg)
+		}
+	}
+	return rv, nil
+}
+
+// Remove deletes the registration id.
+func (d *Directory) Remove(id string) error {
+	if err := d.store.Delete(id); err != nil {
+		return err
+	}
+	d.changed(id, nil)
+	return nil
+}
+
+func (d *Directory) register(req *coap.Message) *coap.Message {
+	if cf := req.ContentFormat(); cf != coap.AppLinkFormat && cf != coap.None {
+		return req.MakeReply(coap.RspCodeUnsupportedMediaType, nil)
+	}
+	links, err := req.LinkFormat()
+	if err != nil {
+		return badRequest(req, err.Error())
+	}
+
+	now := time.Now()
+	reg := &Registration{
+		Lifetime: DefaultLifetime,
+		Attrs:    map[string]string{},
+		Links:    links,
+		Created:  now,
+	}
+	for _, p := range queryParams(req) {
+		switch p[0] {
+		case "ep":
+			reg.Endpoint = p[1]
+		case "d":
+			reg.Sector = p[1]
+		default:
+			if err := reg.apply(p[0], p[1]); err != nil {
+				return badRequest(req, err.Error())
+			}
+		}
+	}
+	if len(reg.Endpoint) == 0 {
+		return badRequest(req, "endpoint name required")
+	}
+	if len(reg.Base) == 0 {
+		reg.Base = baseURI(req)
+	}
+
+	d.mux.Lock()
+	regs, err := d.store.List()
+	if err != nil {
+		d.mux.Unlock()
+		return req.MakeReply(coap.RspCodeInternalServerError, nil)
+	}
+	for _, old := range regs {
+		if old.Endpoint == reg.Endpoint && old.Sector == reg.Sector {
+			// a new registration of the same endpoint replaces the old one
+			// and keeps its location (RFC 9176 section 5.3)
+			reg.ID = old.ID
+			if !old.Expired(now) {
+				reg.Created = old.Created
+			}
+			break
+		}
+	}
+	if len(reg.ID) == 0 {
+		reg.ID = newID()
+	}
+	reg.Updated = now
+	reg.Expires = now.Add(reg.Lifetime)
+	err = d.store.Save(reg)
+	d.mux.Unlock()
+	if err != nil {
+		return req.MakeReply(coap.RspCodeInternalServerError, nil)
+	}
+	d.changed(reg.ID, reg)
+
+	return req.MakeReply(coap.RspCodeCreated, nil).WithLocationPathString(reg.Path())
+}
+
+// registration serves the registration resource: POST updates it, GET
+// returns its links and DELETE removes it (RFC 9176 section 5.3).
+func (d *Directory) registration(req *coap.Message) *coap.Message {
+	id := req.PathVars["id"]
+	if len(req.Path()) != 2 {
+		return req.MakeReply(coap.RspCodeNotFound, nil)
+	}
+
+	d.mux.Lock()
+	rsp, reg, changed := d.updateRegistration(req, id)
+	d.mux.Unlock()
+	if changed {
+		d.changed(id, reg)
+	}
+	return rsp
+}
+
+// updateRegistration serves the registration resource with d.mux held and
+// returns whether it was changed, reg is nil when it was removed.
+func (d *Directory) updateRegistration(req *coap.Message, id string) (rsp *coap.Message, reg *Registration, changed bool) {
+	reg, err := d.store.Load(id)
+	if err != nil || reg.Expired(time.Now()) {
+		return req.MakeReply(coap.RspCodeNotFound, nil), nil, false
+	}
+
+	switch req.Code {
+	case coap.CodeGet:
+		return linkReply(req, reg.Links), nil, false
+	case coap.CodePost:
+		reg = reg.clone()
+		for _, p := range queryParams(req) {
+			if p[0] == "ep" || p[0] == "d" {
+				return badRequest(req, "endpoint name and sector cannot be updated"), nil, false
+			}
+			if err := reg.apply(p[0], p[1]); err != nil {
+				return badRequest(req, err.Error()), nil, false
+			}
+		}
+		if len(req.Payload) != 0 {
+			links, err := req.LinkFormat()
+			if err != nil {
+				return badRequest(req, err.Error()), nil, false
+			}
+			reg.Links = links
+		}
+		now := time.Now()
+		reg.Updated = now
+		reg.Expires = now.Add(reg.Lifetime)
+		if err := d.store.Save(reg); err != nil {
+			return req.MakeReply(coap.RspCodeInternalServerError, nil), nil, false
+		}
+		return req.MakeReply(coap.RspCodeChanged, nil), reg, true
+	case coap.CodeDelete:
+		if err := d.store.Delete(id); err != nil {
+			return req.MakeReply(coap.RspCodeNotFound, nil), nil, false
+		}
+		return req.MakeReply(coap.RspCodeDeleted, nil), nil, true
+	}
+	return req.MakeReply(coap.RspCodeMethodNotAllowed, nil), nil, false
+}
+
+// apply sets a registration parameter other than ep and d.
+func (r *Registration) apply(name string, value string) error {
+	switch name {
+	case "lt":
+		lt, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || lt == 0 {
+			return errInvalidParam(name)
+		}
+		r.Lifetime = time.Duration(lt) * time.Second
+	case "base":
+		if !strings.Contains(value, "://") {
+			return errInvalidParam(name)
+		}
+		r.Base = strings.TrimSuffix(value, "/")
+	case "et":
+		r.EndpointType = value
+	case "page", "count", "href", "anchor":
+		return errInvalidParam(name)
+	default:
+		r.Attrs[name] = value
+	}
+	return nil
+}
+
+func (d *Directory) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.shutdown:
+			return
+		case now := <-ticker.C:
+			regs, err := d.store.List()
+			if err != nil {
+				continue
+			}
+			for _, reg := range regs {
+				if !reg.Expired(now) {
+					continue
+				}
+				d.mux.Lock()
+				// an update may have raced the expiry
+				if cur, err := d.store.Load(reg.ID); err == nil && cur.Expired(now) {
+					if d.store.Delete(reg.ID) == nil {
+						d.mux.Unlock()
+						d.changed(reg.ID, nil)
+						continue
+					}
+				}
+				d.mux.Unlock()
+			}
+		}
+	}
+}
+
+func (d *Directory) changed(id string, reg *Registration) {
+	if d.OnChange != nil {
+		d.OnChange(id, reg)
+	}
+}
+
+func errInvalidParam(name string) error {
+	return errors.New("rd: invalid parameter " + name)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// baseURI returns the scheme and address the request arrived from, used as
+// the base of a registration without the base parameter.
+func baseURI(req *coap.Message) string {
+	scheme := "coap"
+	switch req.Meta.ListenerName {
+	case "dtls":
+		scheme = "coaps"
+	case "tcp":
+		scheme = "coap+tcp"
+	case "tls":
+		scheme = "coaps+tcp"
+	case "ws":
+		scheme = "coap+ws"
+	}
+	return scheme + "://" + req.Meta.RemoteAddr
+}
+
+// queryParams splits the Uri-Query options into name and value, in order.
+func queryParams(req *coap.Message) [][2]string {
+	var params [][2]string
+	for _, q := range req.Options(coap.OptURIQuery) {
+		qs, ok := q.(string)
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(qs, "=", 2)
+		if len(parts) == 1 {
+			params = append(params, [2]string{parts[0], ""})
+		} else {
+			params = append(params, [2]string{parts[0], parts[1]})
+		}
+	}
+	return params
+}
+
+func linkReply(req *coap.Message, lf linkformat.LinkFormat) *coap.Message {
+	rsp := req.MakeReply(coap.RspCodeContent, nil).WithLinkFormat(lf)
+	if rsp.Meta.BlockSize == 0 && req.Meta.Server != nil {
+		rsp.Meta.BlockSize = req.Meta.Server.GetConfig().BlockDefaultSize
+	}
+	return rsp
+}
+
+func badRequest(req *coap.Message, diagnostic string) *coap.Message {
+	return req.MakeReply(coap.RspCodeBadRequest, []byte(diagnostic))
+}
@@ -0,0 +1,290 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qwerty-iot/coap"
+	"github.com/qwerty-iot/coap/linkformat"
+)
+
+type change struct {
+	id  string
+	reg *Registration
+}
+
+type testDirectory struct {
+	*Directory
+	t       *testing.T
+	client  *coap.Server
+	addr    string
+	changes chan change
+	locked  chan bool
+}
+
+// newTestDirectory mounts a Directory on a loopback server and returns it
+// with a client to reach it. Every OnChange call is recorded together with
+// whether it was made while the directory was locked.
+func newTestDirectory(t *testing.T) *testDirectory {
+	t.Helper()
+	s, err := coap.NewServer(nil, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	client, err := coap.NewServer(nil, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+
+	d := &testDirectory{
+		Directory: Mount(s, nil),
+		t:         t,
+		client:    client,
+		changes:   make(chan change, 16),
+		locked:    make(chan bool, 16),
+	}
+	t.Cleanup(d.Close)
+	port, _ := s.GetPorts()
+	d.addr = fmt.Sprintf("127.0.0.1:%d", port)
+	d.OnChange = func(id string, reg *Registration) {
+		if d.mux.TryLock() {
+			d.mux.Unlock()
+			d.locked <- false
+		} else {
+			d.locked <- true
+		}
+		d.changes <- change{id, reg}
+	}
+	return d
+}
+
+func (d *testDirectory) request(code coap.COAPCode, path string, query map[string]string, payload string) *coap.Message {
+	d.t.Helper()
+	req := coap.NewMessage()
+	req.Type = coap.TypeConfirmable
+	req.Code = code
+	req.WithPathString(path)
+	req.WithQuery(query)
+	if len(payload) != 0 {
+		req.WithPayload([]byte(payload)).WithContentFormat(coap.AppLinkFormat)
+	}
+	rsp, err := d.client.Send(d.addr, req, nil)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return rsp
+}
+
+// register registers ep and returns the location of its registration.
+func (d *testDirectory) register(query map[string]string, payload string) string {
+	d.t.Helper()
+	rsp := d.request(coap.CodePost, RegistrationPath, query, payload)
+	if rsp.Code != coap.RspCodeCreated {
+		d.t.Fatalf("register %v: %s %s", query, rsp.Code.NumberString(), rsp.Payload)
+	}
+	d.changed()
+	return "/" + rsp.LocationPathString()
+}
+
+// changed returns the next OnChange call.
+func (d *testDirectory) changed() change {
+	d.t.Helper()
+	select {
+	case c := <-d.changes:
+		if <-d.locked {
+			d.t.Errorf("OnChange of %s called with the directory locked", c.id)
+		}
+		return c
+	case <-time.After(5 * time.Second):
+		d.t.Fatal("OnChange not called")
+	}
+	return change{}
+}
+
+func (d *testDirectory) lookup(path string, query map[string]string) linkformat.LinkFormat {
+	d.t.Helper()
+	rsp := d.request(coap.CodeGet, path, query, "")
+	if rsp.Code != coap.RspCodeContent {
+		d.t.Fatalf("lookup %s %v: %s", path, query, rsp.Code.NumberString())
+	}
+	lf, err := linkformat.Parse(rsp.Payload)
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	return lf
+}
+
+func attrs(lf linkformat.LinkFormat, name string) []string {
+	var values []string
+	for _, l := range lf {
+		v, _ := l.Attr(name)
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestRegistration(t *testing.T) {
+	d := newTestDirectory(t)
+
+	if rsp := d.request(coap.CodePost, RegistrationPath, nil, "</a>"); rsp.Code != coap.RspCodeBadRequest {
+		t.Errorf("registration without ep: %s", rsp.Code.NumberString())
+	}
+	if rsp := d.request(coap.CodePost, RegistrationPath, map[string]string{"ep": "n", "lt": "0"}, "</a>"); rsp.Code != coap.RspCodeBadRequest {
+		t.Errorf("registration with lt=0: %s", rsp.Code.NumberString())
+	}
+
+	loc := d.register(map[string]string{"ep": "node1", "et": "sensor"}, "</temp>;rt=temperature")
+	regs, err := d.Registrations()
+	if err != nil || len(regs) != 1 {
+		t.Fatalf("%d registrations, %v", len(regs), err)
+	}
+	reg := regs[0]
+	if loc != reg.Path() || reg.Endpoint != "node1" || reg.EndpointType != "sensor" || reg.Lifetime != DefaultLifetime {
+		t.Errorf("registered %+v at %s", reg, loc)
+	}
+	if port, _ := d.client.GetPorts(); reg.Base != fmt.Sprintf("coap://127.0.0.1:%d", port) {
+		t.Errorf("base %q", reg.Base)
+	}
+
+	rsp := d.request(coap.CodeGet, loc, nil, "")
+	if rsp.Code != coap.RspCodeContent || string(rsp.Payload) != "</temp>;rt=temperature" {
+		t.Errorf("read %s %s", rsp.Code.NumberString(), rsp.Payload)
+	}
+
+	// registering the endpoint again keeps its location
+	if again := d.register(map[string]string{"ep": "node1"}, "</hum>"); again != loc {
+		t.Errorf("registered again at %s, expected %s", again, loc)
+	}
+}
+
+func TestRegistrationUpdate(t *testing.T) {
+	d := newTestDirectory(t)
+	loc := d.register(map[string]string{"ep": "node1"}, "</temp>")
+
+	if rsp := d.request(coap.CodePost, loc, map[string]string{"lt": "120"}, ""); rsp.Code != coap.RspCodeChanged {
+		t.Fatalf("update %s", rsp.Code.NumberString())
+	}
+	c := d.changed()
+	if c.reg == nil || c.reg.Lifetime != 120*time.Second || c.reg.Links.String() != "</temp>" {
+		t.Errorf("updated to %+v", c.reg)
+	}
+
+	if rsp := d.request(coap.CodePost, loc, nil, "</hum>;rt=humidity"); rsp.Code != coap.RspCodeChanged {
+		t.Fatalf("update %s", rsp.Code.NumberString())
+	}
+	if c = d.changed(); c.reg.Links.String() != "</hum>;rt=humidity" || c.reg.Lifetime != 120*time.Second {
+		t.Errorf("updated to %+v", c.reg)
+	}
+
+	if rsp := d.request(coap.CodePost, loc, map[string]string{"ep": "other"}, ""); rsp.Code != coap.RspCodeBadRequest {
+		t.Errorf("update of ep: %s", rsp.Code.NumberString())
+	}
+	if rsp := d.request(coap.CodePost, RegistrationPath+"/unknown", nil, ""); rsp.Code != coap.RspCodeNotFound {
+		t.Errorf("update of unknown registration: %s", rsp.Code.NumberString())
+	}
+}
+
+func TestRegistrationDelete(t *testing.T) {
+	d := newTestDirectory(t)
+	loc := d.register(map[string]string{"ep": "node1"}, "</temp>")
+
+	if rsp := d.request(coap.CodeDelete, loc, nil, ""); rsp.Code != coap.RspCodeDeleted {
+		t.Fatalf("delete %s", rsp.Code.NumberString())
+	}
+	if c := d.changed(); RegistrationPath+"/"+c.id != loc || c.reg != nil {
+		t.Errorf("delete reported as %+v", c)
+	}
+	if rsp := d.request(coap.CodeGet, loc, nil, ""); rsp.Code != coap.RspCodeNotFound {
+		t.Errorf("read after delete: %s", rsp.Code.NumberString())
+	}
+	if rsp := d.request(coap.CodeDelete, loc, nil, ""); rsp.Code != coap.RspCodeNotFound {
+		t.Errorf("second delete: %s", rsp.Code.NumberString())
+	}
+}
+
+func TestRegistrationExpiry(t *testing.T) {
+	d := newTestDirectory(t)
+	loc := d.register(map[string]string{"ep": "node1", "lt": "1"}, "</temp>")
+
+	if c := d.changed(); c.reg != nil || loc != RegistrationPath+"/"+c.id {
+		t.Errorf("expiry reported as %+v", c)
+	}
+	if rsp := d.request(coap.CodeGet, loc, nil, ""); rsp.Code != coap.RspCodeNotFound {
+		t.Errorf("read after expiry: %s", rsp.Code.NumberString())
+	}
+	if regs, _ := d.Registrations(); len(regs) != 0 {
+		t.Errorf("%d registrations after expiry", len(regs))
+	}
+}
+
+func TestEndpointLookup(t *testing.T) {
+	d := newTestDirectory(t)
+	for i, ep := range []string{"n1", "n2", "n3"} {
+		rt := "light"
+		if i == 1 {
+			rt = "temperature"
+		}
+		d.register(map[string]string{"ep": ep, "d": "floor1"}, "</s>;rt="+rt)
+	}
+
+	tests := []struct {
+		query map[string]string
+		want  []string
+	}{
+		{nil, []string{"n1", "n2", "n3"}},
+		{map[string]string{"ep": "n2"}, []string{"n2"}},
+		{map[string]string{"ep": "n*"}, []string{"n1", "n2", "n3"}},
+		{map[string]string{"rt": "temperature"}, []string{"n2"}},
+		{map[string]string{"rt": "core.rd-ep"}, []string{"n1", "n2", "n3"}},
+		{map[string]string{"d": "floor2"}, nil},
+		{map[string]string{"count": "2"}, []string{"n1", "n2"}},
+		{map[string]string{"count": "2", "page": "1"}, []string{"n3"}},
+		{map[string]string{"count": "2", "page": "2"}, nil},
+		{map[string]string{"page": "1"}, []string{"n1", "n2", "n3"}},
+		{map[string]string{"count": "0"}, nil},
+	}
+	for _, tt := range tests {
+		if got := attrs(d.lookup(EndpointLookupPath, tt.query), "ep"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: found %v, expected %v", tt.query, got, tt.want)
+		}
+	}
+
+	if rsp := d.request(coap.CodeGet, EndpointLookupPath, map[string]string{"count": "-1"}, ""); rsp.Code != coap.RspCodeBadRequest {
+		t.Errorf("count=-1: %s", rsp.Code.NumberString())
+	}
+}
+
+func TestResourceLookup(t *testing.T) {
+	d := newTestDirectory(t)
+	base := "coap://[2001:db8::1]:5683"
+	d.register(map[string]string{"ep": "n1", "base": base + "/"},
+		`</sensors/temp>;rt=temperature,<light>;rt=light;anchor="/sensors",<coap://other/x>;anchor="coap://other"`)
+	d.register(map[string]string{"ep": "n2", "base": "coap://h"}, "</sensors/temp>;rt=temperature")
+
+	tests := []struct {
+		query map[string]string
+		want  string
+	}{
+		{map[string]string{"ep": "n1"}, `<coap://[2001:db8::1]:5683/sensors/temp>;rt=temperature;anchor="coap://[2001:db8::1]:5683",` +
+			`<coap://[2001:db8::1]:5683/light>;rt=light;anchor="coap://[2001:db8::1]:5683/sensors",` +
+			`<coap://other/x>;anchor="coap://other"`},
+		{map[string]string{"rt": "temperature"}, `<coap://[2001:db8::1]:5683/sensors/temp>;rt=temperature;anchor="coap://[2001:db8::1]:5683",` +
+			`<coap://h/sensors/temp>;rt=temperature;anchor="coap://h"`},
+		{map[string]string{"href": "coap://h/*"}, `<coap://h/sensors/temp>;rt=temperature;anchor="coap://h"`},
+		{map[string]string{"count": "1", "page": "2"}, `<coap://other/x>;anchor="coap://other"`},
+		{map[string]string{"rt": "temperature", "count": "1", "page": "1"}, `<coap://h/sensors/temp>;rt=temperature;anchor="coap://h"`},
+	}
+	for _, tt := range tests {
+		if got := d.lookup(ResourceLookupPath, tt.query).String(); got != tt.want {
+			t.Errorf("%v: found %s, expected %s", tt.query, got, tt.want)
+		}
+	}
+}
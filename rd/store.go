@@ -0,0 +1,125 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package rd
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qwerty-iot/coap/linkformat"
+)
+
+var (
+	ErrNotFound = errors.New("rd: registration not found")
+)
+
+// Registration is an endpoint registered with the Directory together with the
+// links it published.
+type Registration struct {
+	ID           string
+	Endpoint     string
+	Sector       string
+	Base         string
+	EndpointType string
+	Lifetime     time.Duration
+	// Attrs holds further registration parameters given in the query, an
+	// empty value is a flag.
+	Attrs   map[string]string
+	Links   linkformat.LinkFormat
+	Created time.Time
+	Updated time.Time
+	Expires time.Time
+}
+
+// Path returns the registration resource of r.
+func (r *Registration) Path() string {
+	return RegistrationPath + "/" + r.ID
+}
+
+// Expired returns true if the lifetime of r ran out before now.
+func (r *Registration) Expired(now time.Time) bool {
+	return now.After(r.Expires)
+}
+
+func (r *Registration) clone() *Registration {
+	c := *r
+	c.Attrs = map[string]string{}
+	for k, v := range r.Attrs {
+		c.Attrs[k] = v
+	}
+	c.Links = append(linkformat.LinkFormat(nil), r.Links...)
+	return &c
+}
+
+// Store keeps the registrations of a Directory. Implementations must be safe
+// for concurrent use, the Directory never modifies a registration it passed
+// to or received from the Store.
+type Store interface {
+	// Save creates or replaces the registration with the ID of reg.
+	Save(reg *Registration) error
+	// Load returns the registration id, or ErrNotFound.
+	Load(id string) (*Registration, error)
+	// Delete removes the registration id, or returns ErrNotFound.
+	Delete(id string) error
+	// List returns all registrations, including expired ones.
+	List() ([]*Registration, error)
+}
+
+// MemoryStore is a Store holding the registrations in memory.
+type MemoryStore struct {
+	regs map[string]*Registration
+	mux  sync.RWMutex
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{regs: map[string]*Registration{}}
+}
+
+func (s *MemoryStore) Save(reg *Registration) error {
+	s.mux.Lock()
+	s.regs[reg.ID] = reg
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Load(id string) (*Registration, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	reg, found := s.regs[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return reg, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, found := s.regs[id]; !found {
+		return ErrNotFound
+	}
+	delete(s.regs, id)
+	return nil
+}
+
+// List returns the registrations ordered by creation time.
+func (s *MemoryStore) List() ([]*Registration, error) {
+	s.mux.RLock()
+	regs := make([]*Registration, 0, len(s.regs))
+	for _, reg := range s.regs {
+		regs = append(regs, reg)
+	}
+	s.mux.RUnlock()
+	sort.Slice(regs, func(i, j int) bool {
+		if regs[i].Created.Equal(regs[j].Created) {
+			return regs[i].ID < regs[j].ID
+		}
+		return regs[i].Created.Before(regs[j].Created)
+	})
+	return regs, nil
+}
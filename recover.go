@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is a panic recovered while handling or encoding a message, it
+// is passed to the log hook along with the message.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("coap: panic: %v", e.Value)
+}
+
+func newPanicError(r interface{}) *PanicError {
+	return &PanicError{Value: r, Stack: debug.Stack()}
+}
+
+func logPanic(msg *Message, err error) {
+	if pe, ok := err.(*PanicError); ok {
+		logError(msg, pe, "coap: recovered from panic\n%s", string(pe.Stack))
+	} else {
+		logError(msg, err, "coap: error encoding message")
+	}
+}
+
+// internalError returns the reply to req when the Server failed handling it,
+// a 5.00 to requests and a reset to other confirmable messages.
+func internalError(req *Message) *Message {
+	if req.Code == CodeEmpty || !req.IsRequest() {
+		if req.Type != TypeConfirmable {
+			return nil
+		}
+		return &Message{
+			Type:      TypeReset,
+			Code:      CodeEmpty,
+			MessageID: req.MessageID,
+		}
+	}
+	rsp := req.MakeReply(RspCodeInternalServerError, nil)
+	if req.Type == TypeNonConfirmable {
+		rsp.Type = TypeNonConfirmable
+	}
+	return rsp
+}
+
+// callRoute runs callback outside of handleMessage, replying 5.00 if it
+// panics.
+func callRoute(callback RouteCallback, req *Message) (rsp *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logPanic(req, newPanicError(r))
+			rsp = req.MakeReply(RspCodeInternalServerError, nil)
+		}
+	}()
+	return callback(req)
+}
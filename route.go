@@ -5,31 +5,70 @@
 package coap
 
 import (
+	"sort"
 	"strings"
 )
 
 type RouteCallback func(req *Message) *Message
 
 type routeEntry struct {
-	children map[string]*routeEntry
-	key      string
-	callback RouteCallback
+	children   map[string]*routeEntry
+	key        string
+	path       string
+	callback   RouteCallback
+	methods    map[COAPCode]RouteCallback
+	middleware []Middleware
+	link       *LinkAttributes
 }
 
-func (s *Server) AddRoute(path string, callback RouteCallback) {
+// RouteOption configures a route added with AddRoute.
+type RouteOption func(route *routeEntry)
 
-	if path == "/" {
-		routeMap := s.routes
-		routeMap["*"] = &routeEntry{children: map[string]*routeEntry{}, callback: callback}
-		return
+// RouteInfo describes a route for diagnostics.
+type RouteInfo struct {
+	Path string
+	// Methods lists the methods with their own callback, sorted by code.
+	Methods []COAPCode
+	// Any is true if the route has a callback for every other method.
+	Any bool
+}
+
+// AddRoute sets the callback of path for every method without its own
+// callback from AddMethodRoute.
+func (s *Server) AddRoute(path string, callback RouteCallback, opts ...RouteOption) {
+	route := s.addRoute(path)
+	route.callback = callback
+	for _, opt := range opts {
+		opt(route)
 	}
+}
 
-	pathParts := strings.Split(path, "/")
-	var route *routeEntry
-	var found bool
-	routeMap := s.routes
+// AddMethodRoute sets the callback of path for a single request method, the
+// route replies 4.05 Method Not Allowed to methods it has no callback for.
+func (s *Server) AddMethodRoute(method COAPCode, path string, callback RouteCallback, opts ...RouteOption) {
+	route := s.addRoute(path)
+	if route.methods == nil {
+		route.methods = map[COAPCode]RouteCallback{}
+	}
+	route.methods[method] = callback
+	for _, opt := range opts {
+		opt(route)
+	}
+}
 
-	for idx, part := range pathParts {
+// addRoute returns the entry of path, adding it and its parents as needed.
+func (s *Server) addRoute(path string) *routeEntry {
+	if path == "/" {
+		route, found := s.routes["*"]
+		if !found {
+			route = &routeEntry{children: map[string]*routeEntry{}, path: path}
+			s.routes["*"] = route
+		}
+		return route
+	}
+
+	route := &routeEntry{children: s.routes}
+	for _, part := range strings.Split(path, "/") {
 		if len(part) == 0 {
 			continue
 		}
@@ -39,23 +78,35 @@ func (s *Server) AddRoute(path string, callback RouteCallback) {
 			part = "*"
 		}
 
-		if route, found = routeMap[part]; found {
-			if idx == len(pathParts)-1 {
-				route.callback = callback
-			} else {
-				routeMap = route.children
-			}
-		} else {
-			if idx == len(pathParts)-1 {
-				route = &routeEntry{children: map[string]*routeEntry{}, callback: callback, key: key}
-			} else {
-				route = &routeEntry{children: map[string]*routeEntry{}, key: key}
-			}
-			routeMap[part] = route
-			routeMap = route.children
+		child, found := route.children[part]
+		if !found {
+			child = &routeEntry{children: map[string]*routeEntry{}, key: key}
+			route.children[part] = child
 		}
+		route = child
 	}
-	return
+	route.path = "/" + strings.Trim(path, "/")
+	return route
+}
+
+// handler returns the callback of the route for method wrapped in the route
+// middleware, nil if the route has no callbacks at all.
+func (r *routeEntry) handler(method COAPCode) RouteCallback {
+	if callback, found := r.methods[method]; found {
+		return chain(r.middleware, callback)
+	}
+	if r.callback != nil || len(r.methods) == 0 {
+		return chain(r.middleware, r.callback)
+	}
+	return chain(r.middleware, methodNotAllowed)
+}
+
+func (r *routeEntry) hasHandler() bool {
+	return r.callback != nil || len(r.methods) != 0
+}
+
+func methodNotAllowed(req *Message) *Message {
+	return req.MakeReply(RspCodeMethodNotAllowed, nil)
 }
 
 func (s *Server) matchRoutes(msg *Message) RouteCallback {
@@ -66,14 +117,14 @@ func (s *Server) matchRoutes(msg *Message) RouteCallback {
 
 	routeMap := s.routes
 
-	var deepestCallback RouteCallback
+	var deepest *routeEntry
 	for _, part := range pathParts {
 		if route, found = routeMap[part]; found {
-			deepestCallback = route.callback
+			deepest = route
 			routeMap = route.children
 		} else {
 			if route, found = routeMap["*"]; found {
-				deepestCallback = route.callback
+				deepest = route
 				if msg.PathVars == nil {
 					msg.PathVars = map[string]string{}
 				}
@@ -84,30 +135,54 @@ func (s *Server) matchRoutes(msg *Message) RouteCallback {
 			}
 		}
 	}
-	return deepestCallback
+	if deepest == nil {
+		return nil
+	}
+	return deepest.handler(msg.Code)
 }
 
 func (s *Server) getSpecialRoute(path string) RouteCallback {
-	pathParts := []string{path}
-
-	var route *routeEntry
-	var found bool
+	route, found := s.routes[path]
+	if !found {
+		route, found = s.routes["*"]
+	}
+	if !found {
+		return nil
+	}
+	return chain(s.middleware, chain(route.middleware, route.callback))
+}
 
-	routeMap := s.routes
+// Routes lists the routes with a callback, sorted by path.
+func (s *Server) Routes() []RouteInfo {
+	var infos []RouteInfo
+	for _, route := range s.walkRoutes() {
+		info := RouteInfo{Path: route.path, Any: route.callback != nil}
+		for method := range route.methods {
+			info.Methods = append(info.Methods, method)
+		}
+		sort.Slice(info.Methods, func(i, j int) bool {
+			return info.Methods[i] < info.Methods[j]
+		})
+		infos = append(infos, info)
+	}
+	return infos
+}
 
-	var deepestCallback RouteCallback
-	for _, part := range pathParts {
-		if route, found = routeMap[part]; found {
-			deepestCallback = route.callback
-			routeMap = route.children
-		} else {
-			if route, found = routeMap["*"]; found {
-				deepestCallback = route.callback
-				routeMap = route.children
-			} else {
-				break
+// walkRoutes returns the routes with a callback, sorted by path.
+func (s *Server) walkRoutes() []*routeEntry {
+	var routes []*routeEntry
+	var walk func(routeMap map[string]*routeEntry)
+	walk = func(routeMap map[string]*routeEntry) {
+		for _, route := range routeMap {
+			if route.hasHandler() {
+				routes = append(routes, route)
 			}
+			walk(route.children)
 		}
 	}
-	return deepestCallback
+	walk(s.routes)
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].path < routes[j].path
+	})
+	return routes
 }
@@ -5,18 +5,67 @@
 package coap
 
 import (
+	"context"
 	"errors"
 	"math"
 	"math/rand"
-	"strings"
 	"time"
-
-	"github.com/qwerty-iot/dtls/v2"
 )
 
 func (s *Server) Send(addr string, msg *Message, options *SendOptions) (*Message, error) {
-	var rsp *Message
-	var err error
+	return s.SendContext(context.Background(), addr, msg, options)
+}
+
+// SendContext is Send that gives up when ctx is done, returning ctx.Err()
+// without further retransmissions. A request answered with a 4.01 carrying
+// an Echo option is sent once more with that Echo (RFC 9175 section 2.4).
+func (s *Server) SendContext(ctx context.Context, addr string, msg *Message, options *SendOptions) (*Message, error) {
+	msg.withNoResponse(options)
+	payload, opts := msg.Payload, make([]option, len(msg.opts))
+	copy(opts, msg.opts)
+	rsp, err := s.sendContext(ctx, addr, msg, options)
+	if echo := echoChallenge(msg, rsp); echo != nil {
+		logDebug(rsp, nil, "echo challenge received, resending request")
+		msg.Payload, msg.opts = payload, opts
+		msg.WithOption(OptEcho, echo, true)
+		msg.MessageID = 0
+		return s.sendContext(ctx, addr, msg, options)
+	}
+	return rsp, err
+}
+
+func (s *Server) sendContext(ctx context.Context, addr string, msg *Message, options *SendOptions) (*Message, error) {
+	if msg.IsRequest() && msg.Code != CodeEmpty && msg.Option(OptOscore) == nil {
+		if oc := s.oscorePeer(addr); oc != nil {
+			return s.sendOscore(ctx, addr, msg, oc, options)
+		}
+	}
+	return s.sendPlain(ctx, addr, msg, options)
+}
+
+// sendPlain is sendContext without the OSCORE protection of requests to
+// OSCORE peers.
+func (s *Server) sendPlain(ctx context.Context, addr string, msg *Message, options *SendOptions) (rsp *Message, err error) {
+	if !s.beginExchange() {
+		return nil, ErrServerClosed
+	}
+	defer s.endExchange()
+
+	// closing the Server aborts the exchange as well
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	defer func() {
+		if err == context.Canceled && s.ctx.Err() != nil {
+			err = ErrServerClosed
+		}
+	}()
 
 	msg.Meta.RemoteAddr = addr
 
@@ -31,6 +80,18 @@ func (s *Server) Send(addr string, msg *Message, options *SendOptions) (*Message
 		// chunk and send
 		data := msg.Payload
 		blockSize := msg.Meta.BlockSize
+		if msg.IsRequest() && msg.Option(OptRequestTag) == nil {
+			// keeps concurrent uploads to the same resource apart
+			msg.WithOption(OptRequestTag, []byte(randomString(4)), true)
+		}
+		// only the last block carries No-Response, the others are answered
+		// with 2.31 Continue
+		blockOptions := options
+		if options.NoResponse != 0 {
+			so := *options
+			so.NoResponse = 0
+			blockOptions = &so
+		}
 		blockNum := 0
 		for {
 			offset := blockNum * blockSize
@@ -45,10 +106,25 @@ func (s *Server) Send(addr string, msg *Message, options *SendOptions) (*Message
 			if blockNum == 0 {
 				msg.WithSize1(len(data))
 			}
-			rsp, err = s.send(addr, msg, options)
+			if more {
+				msg.RemoveOption(OptNoResponse)
+				rsp, err = s.send(ctx, addr, msg, blockOptions)
+			} else {
+				msg.withNoResponse(options)
+				rsp, err = s.send(ctx, addr, msg, options)
+			}
 			if err != nil {
 				return nil, err
 			}
+			if rsp == nil {
+				// non-confirmable blocks and suppressed responses are not
+				// waited for
+				if !more {
+					return nil, nil
+				}
+				blockNum++
+				continue
+			}
 			if more && rsp.Code != RspCodeContinue {
 				return nil, errors.New("expected block transfer continue response")
 			}
@@ -69,43 +145,50 @@ func (s *Server) Send(addr string, msg *Message, options *SendOptions) (*Message
 			blockNum++
 		}
 	} else {
-		rsp, err = s.send(addr, msg, options)
+		rsp, err = s.send(ctx, addr, msg, options)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	if rsp != nil {
-		block2 := rsp.GetBlock2()
-		if block2 != nil && block2.More {
+		return s.sendBlock2(ctx, addr, msg, rsp, options)
+	}
+	return rsp, err
+}
 
-			msg.WithBlock1(nil)
-			msg.Payload = nil
+// sendBlock2 retrieves the remaining blocks of a blockwise response (RFC 7959
+// section 2.4) and returns the response with the whole payload.
+func (s *Server) sendBlock2(ctx context.Context, addr string, msg *Message, rsp *Message, options *SendOptions) (*Message, error) {
+	var err error
+	block2 := rsp.GetBlock2()
+	if block2 != nil && block2.More {
 
-			//blockwise requests
-			var data []byte
-			data = append(data, rsp.Payload...)
+		msg.WithBlock1(nil)
+		msg.Payload = nil
 
-			block := 1
-			for {
-				bm := blockInit(block, false, block2.Size)
-				msg.WithBlock2(bm)
-				rsp, err = s.send(addr, msg, options)
-				if err != nil {
-					return nil, err
-				}
-				data = append(data, rsp.Payload...)
-				block++
-				block2 = rsp.GetBlock2()
-				if !block2.More {
-					break
-				}
+		//blockwise requests
+		var data []byte
+		data = append(data, rsp.Payload...)
+
+		block := 1
+		for {
+			bm := blockInit(block, false, block2.Size)
+			msg.WithBlock2(bm)
+			rsp, err = s.send(ctx, addr, msg, options)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, rsp.Payload...)
+			block++
+			block2 = rsp.GetBlock2()
+			if !block2.More {
+				break
 			}
-			rsp.Payload = data
 		}
+		rsp.Payload = data
 	}
-
-	return rsp, err
+	return rsp, nil
 }
 
 func (s *Server) GetNextMsgId() uint16 {
@@ -116,53 +199,50 @@ func (s *Server) GetNextMsgId() uint16 {
 	return nid
 }
 
-func extractProxyName(addr string) string {
-	parts := strings.SplitN(addr, ":", 2)
-	if len(parts) == 2 && strings.Contains(parts[0], ".") {
-		// The prefix is not present, the first part is an IP address
-		return ""
-	}
-	return parts[0]
-}
-
-func (s *Server) send(addr string, msg *Message, options *SendOptions) (*Message, error) {
+func (s *Server) send(ctx context.Context, addr string, msg *Message, options *SendOptions) (*Message, error) {
 	var pendingChan chan *Message
 
 	msg.Meta.RemoteAddr = addr
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if conn := s.findStreamConn(addr); conn != nil {
+		return s.sendStream(ctx, conn, msg, options)
+	}
+
+	t, err := s.transportFor(addr, options)
+	if err != nil {
+		return nil, err
+	}
+	msg.Meta.ListenerName = t.Name()
+	if d, ok := t.(*DtlsListener); ok {
+		msg.Meta.DtlsPeer = d.FindPeer(addr)
+	}
+
 	if msg.IsConfirmable() {
 		nstrt := time.Now().UTC()
-		nstartInc(addr, options.NStart)
-		defer nstartDec(addr)
+		if err := s.nstartInc(ctx, addr, options.NStart); err != nil {
+			return nil, err
+		}
+		defer s.nstartDec(addr)
 		pendingChan = s.pendingSave(msg)
-		if time.Now().UTC().Sub(nstrt).Seconds() > 1.0 || nstartCount(addr, options.NStart) > 0 {
-			logDebug(msg, nil, "nstart delay %.3fs (%d waiting)", time.Now().UTC().Sub(nstrt).Seconds(), nstartCount(addr, options.NStart))
+		if time.Now().UTC().Sub(nstrt).Seconds() > 1.0 || s.nstartCount(addr, options.NStart) > 0 {
+			logDebug(msg, nil, "nstart delay %.3fs (%d waiting)", time.Now().UTC().Sub(nstrt).Seconds(), s.nstartCount(addr, options.NStart))
 		}
 	} else if msg.MessageID == 0 {
 		msg.MessageID = s.GetNextMsgId()
 	}
 
-	data, err := msg.marshalBinary()
-	if err != nil {
-		return nil, err
-	}
-
-	var peer *dtls.Peer
-	if pxy := extractProxyName(addr); pxy != "" {
-		msg.Meta.ListenerName = pxy
-		err = proxyRecv(s, pxy, addr, data)
-	} else if peer = s.dtlsListener.FindPeer(addr); peer != nil {
-		msg.Meta.DtlsPeer = peer
-		msg.Meta.ListenerName = s.dtlsListener.name
-		err = peer.Write(data)
-	} else if s.udpListener != nil {
-		msg.Meta.ListenerName = s.udpListener.name
-		err = s.udpListener.Send(addr, data)
-	} else {
-		err = errors.New("coap: no valid listener")
+	data, err := s.marshalDatagram(msg)
+	if err == nil {
+		err = t.WriteTo(addr, data)
 	}
-
 	if err != nil {
+		if pendingChan != nil {
+			s.pendingDelete(msg)
+		}
 		return nil, err
 	}
 
@@ -173,11 +253,20 @@ func (s *Server) send(addr string, msg *Message, options *SendOptions) (*Message
 		if options.MaxRetransmit == -1 {
 			select {
 			case rsp := <-pendingChan:
+				if rsp.Type == TypeReset {
+					logDebug(rsp, err, "send reset (no retransmits)")
+					return nil, ErrReset
+				}
 				logDebug(rsp, err, "send ack'd (no retransmits)")
 				return rsp, nil
 			case <-time.After(maxWait):
+				s.pendingDelete(msg)
 				logDebug(msg, err, "send timeout (no retransmits)")
 				return nil, ErrTimeout
+			case <-ctx.Done():
+				s.pendingDelete(msg)
+				logDebug(msg, ctx.Err(), "send cancelled (no retransmits)")
+				return nil, ctx.Err()
 			}
 		} else {
 			startTime := time.Now()
@@ -187,11 +276,24 @@ func (s *Server) send(addr string, msg *Message, options *SendOptions) (*Message
 				}
 				select {
 				case rsp := <-pendingChan:
+					if rsp.Type == TypeReset {
+						logDebug(rsp, err, "send reset (%0.2f seconds)", time.Since(startTime).Seconds())
+						return nil, ErrReset
+					}
 					if rsp.Code == CodeEmpty {
-						if msg.IsRequest() {
+						if msg.IsRequest() && options.NoResponse != 0 {
+							// an empty ack only clears the message id, the
+							// token would wait for a response forever
+							s.pendingDelete(msg)
+							logDebug(rsp, err, "send ack'd, no response expected (%0.2f seconds)", time.Since(startTime).Seconds())
+							return nil, nil
+						} else if msg.IsRequest() {
 							logDebug(rsp, err, "send received delayed ack'd (%0.2f seconds)", time.Since(startTime).Seconds())
-							continue
+							// the response follows separately, the request is
+							// no longer retransmitted (RFC 7252 section 5.2.2)
+							return s.sendWaitSeparate(ctx, msg, pendingChan, maxWait-time.Since(startTime))
 						} else {
+							s.pendingDelete(msg)
 							logDebug(rsp, err, "send received empty ack (%0.2f seconds)", time.Since(startTime).Seconds())
 							return rsp, nil
 						}
@@ -203,23 +305,21 @@ func (s *Server) send(addr string, msg *Message, options *SendOptions) (*Message
 					//retransmit
 					if retryCount < options.MaxRetransmit {
 						logDebug(msg, err, "send retry needed (%d/%d transmits, %0.2f seconds)", retryCount+1, options.MaxRetransmit+1, time.Since(startTime).Seconds())
-						if pxy := extractProxyName(addr); pxy != "" {
-							err = proxyRecv(s, pxy, addr, data)
-						} else if peer != nil {
-							err = peer.Write(data)
-						} else if s.udpListener != nil {
-							err = s.udpListener.Send(addr, data)
-						} else {
-							err = errors.New("coap: no valid listener")
-						}
+						err = t.WriteTo(addr, data)
 						timeout *= 2
 						logDebug(msg, err, "resent message (timeout:%0.2fs)", timeout.Seconds())
 						if err != nil {
+							s.pendingDelete(msg)
 							return nil, err
 						}
 					}
+				case <-ctx.Done():
+					s.pendingDelete(msg)
+					logDebug(msg, ctx.Err(), "send cancelled (%d transmits, %0.2f seconds)", retryCount+1, time.Since(startTime).Seconds())
+					return nil, ctx.Err()
 				}
 			}
+			s.pendingDelete(msg)
 			logDebug(msg, err, "send ack timeout (%d transmits, %0.2f seconds)", options.MaxRetransmit+1, time.Since(startTime).Seconds())
 			return nil, ErrTimeout
 		}
@@ -229,6 +329,68 @@ func (s *Server) send(addr string, msg *Message, options *SendOptions) (*Message
 	}
 }
 
+// sendStream sends msg over a reliable stream connection, there are no
+// retransmissions so requests simply wait for the response with the same token.
+func (s *Server) sendStream(ctx context.Context, conn *tcpConn, msg *Message, options *SendOptions) (*Message, error) {
+	var pendingChan chan *Message
+
+	msg.Meta.ListenerName = conn.listener.name
+	msg.Meta.Reliable = true
+
+	if msg.IsRequest() && msg.Code != CodeEmpty && options.NoResponse == 0 {
+		pendingChan = s.pendingSave(msg)
+	}
+
+	err := conn.write(msg)
+	if err != nil {
+		s.pendingDelete(msg)
+		return nil, err
+	}
+
+	if pendingChan == nil {
+		logDebug(msg, err, "sent message (no reply expected)")
+		return nil, nil
+	}
+
+	maxWait := options.ActTimeout
+	if options.MaxRetransmit > 0 {
+		maxWait = time.Duration(float64(float64(options.ActTimeout*time.Duration(math.Pow(2.0, float64(options.MaxRetransmit+1))-1)) * options.RandomFactor))
+	}
+	logDebug(msg, err, "sent message (maxWait:%0.2fs)", maxWait.Seconds())
+
+	select {
+	case rsp := <-pendingChan:
+		logDebug(rsp, err, "send answered")
+		return rsp, nil
+	case <-time.After(maxWait):
+		s.pendingDelete(msg)
+		logDebug(msg, err, "send timeout")
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		s.pendingDelete(msg)
+		logDebug(msg, ctx.Err(), "send cancelled")
+		return nil, ctx.Err()
+	}
+}
+
+// sendWaitSeparate waits for the separate response to msg after its empty
+// acknowledgement.
+func (s *Server) sendWaitSeparate(ctx context.Context, msg *Message, pendingChan chan *Message, timeout time.Duration) (*Message, error) {
+	select {
+	case rsp := <-pendingChan:
+		logDebug(rsp, nil, "send received separate response")
+		return rsp, nil
+	case <-time.After(timeout):
+		s.pendingDelete(msg)
+		logDebug(msg, nil, "send timeout waiting for separate response")
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		s.pendingDelete(msg)
+		logDebug(msg, ctx.Err(), "send cancelled waiting for separate response")
+		return nil, ctx.Err()
+	}
+}
+
 func (s *Server) blockRetreive(req *Message) (*Message, error) {
 
 	obs := s.getObserve(req)
@@ -259,7 +421,7 @@ func (s *Server) blockRetreive(req *Message) (*Message, error) {
 		if af := req.Accept(); af != None {
 			msg.WithContentFormat(af)
 		}
-		rsp, err := s.send(req.Meta.RemoteAddr, msg, s.NewOptions())
+		rsp, err := s.send(req.Context(), req.Meta.RemoteAddr, msg, s.NewOptions())
 		if err != nil {
 			return nil, err
 		}
@@ -13,6 +13,10 @@ type SendOptions struct {
 	BlockSize      int           `json:"BlockSize"`
 	MaxMessageSize int           `json:"MaxMessageSize"`
 	NStart         int           `json:"NStart"`
+	Transport      string        `json:"Transport"`
+	// NoResponse sets the No-Response option of requests (RFC 7967), Send
+	// then returns without waiting for a response.
+	NoResponse uint32 `json:"NoResponse"`
 }
 
 func (s *Server) NewOptions() *SendOptions {
@@ -48,7 +52,21 @@ func (so *SendOptions) WithNStart(ns int) *SendOptions {
 	return so
 }
 
+// WithTransport sends through the transport with the given name instead of
+// the one picked for the address.
+func (so *SendOptions) WithTransport(name string) *SendOptions {
+	so.Transport = name
+	return so
+}
+
 func (so *SendOptions) NoRetry() *SendOptions {
 	so.MaxRetransmit = -1
 	return so
 }
+
+// WithNoResponse suppresses the responses of the classes in nr, a combination
+// of the NoResponse values.
+func (so *SendOptions) WithNoResponse(nr uint32) *SendOptions {
+	so.NoResponse = nr
+	return so
+}
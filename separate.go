@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errResponseWritten = errors.New("coap: response already written")
+
+// ResponseWriter sends the separate response of a request whose route
+// callback called Defer (RFC 7252 section 5.2.2).
+type ResponseWriter struct {
+	req     *Message
+	mux     sync.Mutex
+	written bool
+	// the Server waits for deferred responses when shutting down
+	exchange bool
+}
+
+// Defer separates the response to the request from its acknowledgement, for
+// route callbacks that cannot answer right away. A confirmable request is
+// acknowledged with an empty ACK once the callback returns, whatever it
+// returns is ignored, and the response is sent later with Write.
+func (m *Message) Defer() *ResponseWriter {
+	if m.deferred == nil {
+		m.deferred = &ResponseWriter{req: m}
+		if m.Meta.Server != nil {
+			m.deferred.exchange = m.Meta.Server.beginExchange()
+		}
+	}
+	return m.deferred
+}
+
+// ack returns the empty acknowledgement sent in place of the response.
+func (w *ResponseWriter) ack() *Message {
+	if w.req.Type != TypeConfirmable {
+		return nil
+	}
+	return w.req.MakeReply(CodeEmpty, nil)
+}
+
+// discard gives up on the response after the route callback panicked.
+func (w *ResponseWriter) discard() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if !w.written {
+		w.written = true
+		if w.exchange {
+			w.req.Meta.Server.endExchange()
+		}
+	}
+}
+
+// Write sends rsp, usually made with MakeReply on the request, as the
+// separate response and waits for it to be acknowledged. Confirmable
+// requests are answered with a confirmable response, non-confirmable ones
+// with a non-confirmable response.
+func (w *ResponseWriter) Write(rsp *Message) error {
+	return w.WriteContext(w.req.Context(), rsp)
+}
+
+// WriteContext is Write that stops retransmitting the response when ctx is
+// done.
+func (w *ResponseWriter) WriteContext(ctx context.Context, rsp *Message) error {
+	w.mux.Lock()
+	if w.written {
+		w.mux.Unlock()
+		return errResponseWritten
+	}
+	w.written = true
+	w.mux.Unlock()
+
+	req := w.req
+	s := req.Meta.Server
+	if s == nil {
+		return errors.New("coap: request was not received by a server")
+	}
+	if !w.exchange {
+		return ErrServerClosed
+	}
+	defer s.endExchange()
+
+	if req.suppressesResponse(rsp.Code) {
+		logDebug(req, nil, "separate response %s suppressed by no-response", rsp.Code.NumberString())
+		s.dedupUpdate(req, nil)
+		return nil
+	}
+
+	msg := &Message{
+		Code:    rsp.Code,
+		Token:   req.Token,
+		Payload: rsp.Payload,
+		opts:    append(options{}, rsp.opts...),
+	}
+	if req.oscore != nil {
+		var err error
+		if msg, err = req.oscore.protectResponse(msg); err != nil {
+			return err
+		}
+	}
+
+	so := s.NewOptions()
+	if rsp.Meta.BlockSize != 0 {
+		so.BlockSize = rsp.Meta.BlockSize
+	} else if req.Meta.BlockSize != 0 {
+		so.BlockSize = req.Meta.BlockSize
+	}
+	msg.Meta.BlockSize = so.BlockSize
+	msg.Meta.MaxMessageSize = req.Meta.MaxMessageSize
+	if msg.RequiresBlockwise() {
+		// the client retrieves the remaining blocks with the request, which
+		// are answered with piggybacked responses
+		msg.Type = TypeAcknowledgement
+		s.blockCachePut(msg, req.getBlockKey())
+		first, err := s.blockCacheGet(req, 0, so.BlockSize)
+		if err != nil {
+			return err
+		}
+		msg = first
+	}
+
+	// duplicates of the request are answered with the response from now on
+	piggybacked := *msg
+	piggybacked.MessageID = req.MessageID
+	piggybacked.Type = TypeAcknowledgement
+	if req.Type == TypeNonConfirmable {
+		piggybacked.Type = TypeNonConfirmable
+	}
+	piggybacked.Meta = req.Meta
+	if !req.Meta.Reliable {
+		s.dedupUpdate(req, &piggybacked)
+	}
+
+	msg.Type = req.Type
+	msg.MessageID = 0
+	if msg.Type == TypeNonConfirmable {
+		msg.MessageID = s.GetNextMsgId()
+	}
+	_, err := s.send(ctx, req.Meta.RemoteAddr, msg, so)
+	if msg.Type == TypeConfirmable {
+		// an empty ACK matches by message ID and leaves the token behind
+		s.pendingDelete(msg)
+	}
+	if err != nil {
+		logWarn(msg, err, "coap: error sending separate response")
+		return err
+	}
+	logDebug(msg, nil, "sent separate response")
+	return nil
+}
@@ -0,0 +1,131 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// beginHandler counts a received message as in flight, it returns false
+// once the Server is shutting down.
+func (s *Server) beginHandler() bool {
+	s.drainMux.RLock()
+	defer s.drainMux.RUnlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	atomic.AddInt64(&s.handlers, 1)
+	return true
+}
+
+func (s *Server) endHandler() {
+	atomic.AddInt64(&s.handlers, -1)
+	s.inflight.Done()
+}
+
+// beginExchange counts an exchange started by Send as in flight, it returns
+// false once the Server is shutting down.
+func (s *Server) beginExchange() bool {
+	s.drainMux.RLock()
+	defer s.drainMux.RUnlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	atomic.AddInt64(&s.exchanges, 1)
+	return true
+}
+
+func (s *Server) endExchange() {
+	atomic.AddInt64(&s.exchanges, -1)
+	s.inflight.Done()
+}
+
+// Shutdown stops the Server gracefully: new requests are answered with 5.03
+// Service Unavailable and Send returns ErrServerClosed, while the handlers
+// and exchanges in flight are given until ctx is done to finish. Then the
+// contexts of requests still running are cancelled and the transports and
+// background goroutines are stopped. With Config.ShutdownCancelObservers
+// the observers of the Server are sent a final 5.03 notification.
+//
+// The returned error joins every failure, including ctx.Err() if the
+// deadline was reached before the Server was idle.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainMux.Lock()
+	if s.draining {
+		s.drainMux.Unlock()
+		return ErrServerClosed
+	}
+	s.draining = true
+	s.drainMux.Unlock()
+
+	var errs []error
+	if s.config.ShutdownCancelObservers {
+		s.cancelObservers()
+	}
+
+	idle := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("coap: shutdown with %d handlers and %d exchanges in flight: %w",
+			atomic.LoadInt64(&s.handlers), atomic.LoadInt64(&s.exchanges), ctx.Err()))
+	}
+
+	errs = append(errs, s.close()...)
+
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		if len(errs) == 0 {
+			errs = append(errs, fmt.Errorf("coap: shutdown before background tasks stopped: %w", ctx.Err()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cancelObservers ends every observation of the Server with a 5.03 Service
+// Unavailable notification (RFC 7641 section 3.2).
+func (s *Server) cancelObservers() {
+	s.observers.Range(func(key, value interface{}) bool {
+		o := value.(*observer)
+		rsp := NewMessage().WithCode(RspCodeServiceUnavailable)
+		s.inflight.Add(1)
+		go func() {
+			defer s.inflight.Done()
+			s.notify(key.(string), o, rsp)
+		}()
+		return true
+	})
+}
+
+// close cancels the Server context and closes the transports.
+func (s *Server) close() []error {
+	s.drainMux.Lock()
+	s.draining = true
+	s.drainMux.Unlock()
+	s.cancel()
+	s.abortCalls()
+	servers.Delete(s)
+
+	var errs []error
+	for _, t := range s.Transports() {
+		if err := t.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("coap: closing %s transport: %w", t.Name(), err))
+		}
+	}
+	s.tcpListener.Close()
+	s.tlsListener.Close()
+	s.wsListener.Close()
+	return errs
+}
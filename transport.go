@@ -0,0 +1,188 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Transport carries CoAP messages in their datagram form (RFC 7252) between
+// the Server and remote endpoints, e.g. UDP, DTLS, SMS or an in-memory pipe.
+type Transport interface {
+	// Name identifies the transport, received messages carry it in
+	// Metadata.ListenerName and SendOptions.Transport selects it by name.
+	Name() string
+	// Listen starts the transport, every datagram received until Close must
+	// be passed to receive along with the address of its sender.
+	Listen(receive TransportReceiveFunc) error
+	// WriteTo sends a datagram to the endpoint at addr.
+	WriteTo(addr string, data []byte) error
+	// LocalAddr returns the local address of the transport.
+	LocalAddr() string
+	// Close stops the transport.
+	Close() error
+}
+
+// TransportReceiveFunc hands a datagram received by a Transport to the Server.
+type TransportReceiveFunc func(data []byte, from string)
+
+// EndpointOwner may be implemented by a Transport that knows which endpoints
+// it reaches, Send picks such a transport for those addresses without needing
+// SendOptions.Transport.
+type EndpointOwner interface {
+	HasEndpoint(addr string) bool
+}
+
+// AddTransport starts t and makes it available to Send. The first transport
+// that does not implement EndpointOwner is used for addresses that no other
+// transport claims.
+func (s *Server) AddTransport(t Transport) error {
+	if s.findTransport(t.Name()) != nil {
+		return errors.New("coap: duplicate transport name: " + t.Name())
+	}
+	err := t.Listen(func(data []byte, from string) {
+		s.receive(t, data, from)
+	})
+	if err != nil {
+		return err
+	}
+	s.addTransport(t)
+	return nil
+}
+
+func (s *Server) addTransport(t Transport) {
+	s.transportMux.Lock()
+	s.transports = append(s.transports, t)
+	s.transportMux.Unlock()
+}
+
+// Transports returns the transports of the Server in the order they were added.
+func (s *Server) Transports() []Transport {
+	s.transportMux.RLock()
+	defer s.transportMux.RUnlock()
+	return append([]Transport(nil), s.transports...)
+}
+
+func (s *Server) findTransport(name string) Transport {
+	s.transportMux.RLock()
+	defer s.transportMux.RUnlock()
+	for _, t := range s.transports {
+		if t.Name() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// transportFor picks the transport a message to addr is written to.
+func (s *Server) transportFor(addr string, options *SendOptions) (Transport, error) {
+	if options != nil && len(options.Transport) != 0 {
+		if t := s.findTransport(options.Transport); t != nil {
+			return t, nil
+		}
+		return nil, errors.New("coap: transport not found: " + options.Transport)
+	}
+
+	s.transportMux.RLock()
+	defer s.transportMux.RUnlock()
+	var fallback Transport
+	for _, t := range s.transports {
+		if eo, ok := t.(EndpointOwner); ok {
+			if eo.HasEndpoint(addr) {
+				return t, nil
+			}
+		} else if fallback == nil {
+			fallback = t
+		}
+	}
+	if fallback == nil {
+		return nil, errors.New("coap: no valid listener")
+	}
+	return fallback, nil
+}
+
+// receive handles a datagram that arrived on t and writes the reply back.
+func (s *Server) receive(t Transport, data []byte, from string) {
+	var req Message
+	if err := req.unmarshalBinary(data); err != nil {
+		logError(nil, err, "coap: error parsing COAP header")
+		return
+	}
+	req.Meta.RemoteAddr = from
+	if rsp := s.rejectToken(&req); rsp != nil {
+		if data, err := rsp.marshalBinary(); err == nil {
+			_ = t.WriteTo(from, data)
+		}
+		return
+	} else if len(req.Token) > s.config.MaxTokenLength {
+		return
+	}
+	if d, ok := t.(*DtlsListener); ok {
+		req.Meta.DtlsPeer = d.FindPeer(from)
+	}
+	if _, ok := t.(*MulticastListener); ok {
+		if req.Type == TypeConfirmable {
+			// multicast requests must be non-confirmable (RFC 7252 section 8.1)
+			logDebug(&req, nil, "confirmable multicast request ignored")
+			return
+		}
+		req.Meta.Multicast = true
+	}
+	req.Meta.ListenerName = t.Name()
+	req.Meta.ReceivedAt = time.Now().UTC()
+	req.Meta.Server = s
+
+	rsp := s.handleMessage(&req)
+
+	if rsp != nil {
+		rawRsp, err := rsp.marshalBinary()
+		if err != nil {
+			logPanic(rsp, err)
+			if rsp = internalError(&req); rsp == nil {
+				s.dedupUpdate(&req, nil)
+				return
+			}
+			rsp.Meta = req.Meta
+			s.dedupUpdate(&req, rsp)
+			if rawRsp, err = rsp.marshalBinary(); err != nil {
+				logError(nil, err, "coap: error marshaling COAP response")
+				return
+			}
+		}
+
+		if req.Meta.Multicast {
+			s.multicastReply(t, &req, rsp, rawRsp)
+		} else if rawRsp != nil {
+			if err = t.WriteTo(from, rawRsp); err != nil {
+				logWarn(nil, err, "coap: error writing coap response")
+			}
+		}
+	}
+}
+
+// rejectToken returns the Reset for a confirmable message whose token exceeds
+// Config.MaxTokenLength, it is a message format error (RFC 8974 section
+// 2.2.1).
+func (s *Server) rejectToken(req *Message) *Message {
+	if len(req.Token) <= s.config.MaxTokenLength {
+		return nil
+	}
+	logWarn(req, ErrInvalidTokenLen, "coap: token of %d bytes rejected", len(req.Token))
+	if req.Type != TypeConfirmable {
+		return nil
+	}
+	return &Message{Type: TypeReset, MessageID: req.MessageID}
+}
+
+// marshalDatagram marshals msg for a datagram transport, where tokens are
+// limited to Config.MaxTokenLength.
+func (s *Server) marshalDatagram(msg *Message) ([]byte, error) {
+	if len(msg.Token) > s.config.MaxTokenLength {
+		return nil, fmt.Errorf("%w: %d bytes exceeds %d", ErrInvalidTokenLen, len(msg.Token), s.config.MaxTokenLength)
+	}
+	return msg.marshalBinary()
+}
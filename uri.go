@@ -0,0 +1,278 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPort       = 5683
+	DefaultSecurePort = 5684
+)
+
+// uriSchemes maps the supported URI schemes to the transport they use and
+// their default port (RFC 7252 section 6, RFC 8323 section 8).
+var uriSchemes = map[string]struct {
+	network string
+	port    int
+}{
+	"coap":      {"udp", DefaultPort},
+	"coaps":     {"dtls", DefaultSecurePort},
+	"coap+tcp":  {"tcp", DefaultPort},
+	"coaps+tcp": {"tls", DefaultSecurePort},
+}
+
+// coapURI is an absolute coap URI decomposed into its options.
+type coapURI struct {
+	scheme string
+	host   string
+	port   int
+	path   []string
+	query  []string
+}
+
+// parseURI decomposes uri following RFC 7252 section 6.4, the path segments
+// and query arguments are percent-decoded.
+func parseURI(uri string) (*coapURI, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, ErrInvalidURI
+	}
+	scheme, found := uriSchemes[strings.ToLower(u.Scheme)]
+	if !found || !u.IsAbs() || len(u.Opaque) != 0 || strings.Contains(uri, "#") || len(u.Hostname()) == 0 {
+		return nil, ErrInvalidURI
+	}
+	cu := &coapURI{scheme: strings.ToLower(u.Scheme), host: u.Hostname(), port: scheme.port}
+	if ps := u.Port(); len(ps) != 0 {
+		port, err := strconv.ParseUint(ps, 10, 16)
+		if err != nil {
+			return nil, ErrInvalidURI
+		}
+		cu.port = int(port)
+	}
+	if p := u.EscapedPath(); len(p) != 0 && p != "/" {
+		for _, seg := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+			seg, err := url.PathUnescape(seg)
+			if err != nil {
+				return nil, ErrInvalidURI
+			}
+			cu.path = append(cu.path, seg)
+		}
+	}
+	if len(u.RawQuery) != 0 {
+		for _, arg := range strings.Split(u.RawQuery, "&") {
+			arg, err := url.PathUnescape(arg)
+			if err != nil {
+				return nil, ErrInvalidURI
+			}
+			cu.query = append(cu.query, arg)
+		}
+	}
+	return cu, nil
+}
+
+// addr returns the host and port of the URI in the form Send expects.
+func (cu *coapURI) addr() string {
+	return net.JoinHostPort(cu.host, strconv.Itoa(cu.port))
+}
+
+// WithURI sets the Uri-Host, Uri-Port, Uri-Path and Uri-Query options from an
+// absolute coap, coaps, coap+tcp or coaps+tcp URI (RFC 7252 section 6.4).
+// Uri-Host is left out for IP literals and Uri-Port for the default port of
+// the scheme.
+func (m *Message) WithURI(uri string) (*Message, error) {
+	cu, err := parseURI(uri)
+	if err != nil {
+		return m, err
+	}
+	m.RemoveOption(OptURIHost)
+	m.RemoveOption(OptURIPort)
+	m.RemoveOption(OptURIPath)
+	m.RemoveOption(OptURIQuery)
+	m.queryVars = nil
+	if ip, _, _ := strings.Cut(cu.host, "%"); net.ParseIP(ip) == nil {
+		m.WithOption(OptURIHost, strings.ToLower(cu.host), false)
+	}
+	if cu.port != uriSchemes[cu.scheme].port {
+		m.WithOption(OptURIPort, cu.port, false)
+	}
+	if len(cu.path) != 0 {
+		m.WithPath(cu.path)
+	}
+	for _, q := range cu.query {
+		m.WithOption(OptURIQuery, q, false)
+	}
+	m.uriScheme = cu.scheme
+	m.uriAddr = cu.addr()
+	return m, nil
+}
+
+// URI composes the URI of the request target from the options of the message
+// (RFC 7252 section 6.5). Without Uri-Host or Uri-Port, the host and port the
+// message was sent to are used.
+func (m *Message) URI() string {
+	scheme := m.uriScheme
+	if len(scheme) == 0 {
+		scheme = schemeFor(m.Meta.ListenerName)
+	}
+
+	host, ports, _ := net.SplitHostPort(m.destination())
+	if uh, ok := m.Option(OptURIHost).(string); ok && len(uh) != 0 {
+		host = uh
+	}
+	if up := m.Option(OptURIPort); up != nil {
+		ports = strconv.Itoa(int(optionUint(up)))
+	}
+	if ds, found := uriSchemes[scheme]; found && ports == strconv.Itoa(ds.port) {
+		ports = ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(scheme)
+	sb.WriteString("://")
+	if strings.Contains(host, ":") {
+		sb.WriteString("[" + strings.ReplaceAll(host, "%", "%25") + "]")
+	} else {
+		sb.WriteString(host)
+	}
+	if len(ports) != 0 {
+		sb.WriteString(":" + ports)
+	}
+	path := m.Path()
+	if len(path) == 0 {
+		sb.WriteString("/")
+	}
+	for _, seg := range path {
+		sb.WriteString("/" + escapeURI(seg, "/?"))
+	}
+	for i, q := range m.optionStrings(OptURIQuery) {
+		if i == 0 {
+			sb.WriteString("?")
+		} else {
+			sb.WriteString("&")
+		}
+		sb.WriteString(escapeURI(q, "&"))
+	}
+	return sb.String()
+}
+
+// destination returns the address the message was sent to, which is the
+// local address for a received message.
+func (m *Message) destination() string {
+	if len(m.uriAddr) != 0 {
+		return m.uriAddr
+	}
+	if m.Meta.ReceivedAt.IsZero() || m.Meta.Server == nil {
+		return m.Meta.RemoteAddr
+	}
+	if c := m.Meta.Server.findStreamConn(m.Meta.RemoteAddr); c != nil && c.conn != nil {
+		return c.conn.LocalAddr().String()
+	}
+	if t := m.Meta.Server.findTransport(m.Meta.ListenerName); t != nil {
+		return t.LocalAddr()
+	}
+	return ""
+}
+
+func schemeFor(listenerName string) string {
+	switch listenerName {
+	case "dtls":
+		return "coaps"
+	case "tcp":
+		return "coap+tcp"
+	case "tls":
+		return "coaps+tcp"
+	case "ws":
+		return "coap+ws"
+	}
+	return "coap"
+}
+
+// escapeURI percent-encodes the characters of s that are not allowed in a
+// path segment or query argument, along with those listed in reserved.
+func escapeURI(s string, reserved string) string {
+	const hex = "0123456789ABCDEF"
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if uriAllowed(c) && strings.IndexByte(reserved, c) < 0 {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(hex[c>>4])
+			sb.WriteByte(hex[c&0xf])
+		}
+	}
+	return sb.String()
+}
+
+// uriAllowed reports whether c is unreserved, a sub-delim, ":", "@", "/" or
+// "?" (RFC 3986 section 3.3 and 3.4).
+func uriAllowed(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~!$&'()*+,;=:@/?", c) >= 0
+}
+
+// GetURI sends a confirmable GET for the resource identified by an absolute
+// coap URI, the target address is taken from the URI. Stream connections to
+// coap+tcp and coaps+tcp targets are dialled if needed.
+func (s *Server) GetURI(ctx context.Context, uri string, options *SendOptions) (*Message, error) {
+	msg, err := NewMessage().WithType(TypeConfirmable).WithCode(CodeGet).WithURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := s.uriAddr(msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.uriScheme == "coaps" {
+		if options == nil {
+			options = s.NewOptions()
+		} else {
+			so := *options
+			options = &so
+		}
+		options.Transport = "dtls"
+	}
+	return s.SendContext(ctx, addr, msg, options)
+}
+
+// uriAddr returns the address to send msg to, as set by WithURI.
+func (s *Server) uriAddr(msg *Message) (string, error) {
+	network := uriSchemes[msg.uriScheme].network
+	if network == "tcp" || network == "tls" {
+		// stream connections are known by the resolved address of the peer
+		raddr, err := net.ResolveTCPAddr("tcp", msg.uriAddr)
+		if err != nil {
+			return "", err
+		}
+		addr := raddr.String()
+		if network == "tcp" {
+			if c := s.tcpListener.findConn(addr); c != nil {
+				return c.addr, nil
+			}
+			return s.DialTcp(addr)
+		}
+		if c := s.tlsListener.findConn(addr); c != nil {
+			return c.addr, nil
+		}
+		host, _, _ := net.SplitHostPort(msg.uriAddr)
+		return s.DialTls(addr, &tls.Config{ServerName: host})
+	}
+	uaddr, err := net.ResolveUDPAddr("udp", msg.uriAddr)
+	if err != nil {
+		return "", err
+	}
+	return uaddr.String(), nil
+}
@@ -0,0 +1,42 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestGetURIReusesStreamConn(t *testing.T) {
+	srv := newTestServer(t, nil)
+	srv.AddRoute("hello", func(req *Message) *Message {
+		return req.MakeReply(RspCodeContent, []byte("hi"))
+	})
+	if err := srv.ListenTcp("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(srv.tcpListener.socket.Addr().String())
+
+	client := newTestServer(t, nil)
+	for i := 0; i < 3; i++ {
+		rsp, err := client.GetURI(context.Background(), "coap+tcp://localhost:"+port+"/hello", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rsp.Payload) != "hi" {
+			t.Fatalf("unexpected response %q", rsp.Payload)
+		}
+	}
+	// the server sees every connection dialled
+	conns := 0
+	srv.tcpListener.conns.Range(func(key, value interface{}) bool {
+		conns++
+		return true
+	})
+	if conns != 1 {
+		t.Fatalf("%d connections dialled for one host", conns)
+	}
+}
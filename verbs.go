@@ -0,0 +1,151 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import "context"
+
+type requestConfig struct {
+	msg     *Message
+	options *SendOptions
+}
+
+// RequestOption configures a request made with Get, Post, Put, Delete, Fetch,
+// Patch or IPatch.
+type RequestOption func(rc *requestConfig)
+
+// WithRequestQuery adds Uri-Query options to the request.
+func WithRequestQuery(q map[string]string) RequestOption {
+	return func(rc *requestConfig) {
+		rc.msg.WithQuery(q)
+	}
+}
+
+// WithRequestAccept sets the Accept option of the request.
+func WithRequestAccept(mt MediaType) RequestOption {
+	return func(rc *requestConfig) {
+		rc.msg.WithAccept(mt)
+	}
+}
+
+// WithRequestOption adds an option to the request.
+func WithRequestOption(opID OptionID, val interface{}) RequestOption {
+	return func(rc *requestConfig) {
+		rc.msg.WithOption(opID, val, false)
+	}
+}
+
+// WithRequestSendOptions sends the request with options instead of the
+// defaults.
+func WithRequestSendOptions(options *SendOptions) RequestOption {
+	return func(rc *requestConfig) {
+		rc.options = options
+	}
+}
+
+// NonConfirmable sends the request as a non-confirmable message, the verb
+// returns without waiting for a response.
+func NonConfirmable() RequestOption {
+	return func(rc *requestConfig) {
+		rc.msg.Type = TypeNonConfirmable
+	}
+}
+
+// Get sends a GET for path to addr. The error is set for responses other
+// than 2.xx, the response is returned along with it.
+func (s *Server) Get(ctx context.Context, addr string, path string, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodeGet, path, None, nil, opts)
+}
+
+// Post sends a POST for path to addr with body in content format ct.
+func (s *Server) Post(ctx context.Context, addr string, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodePost, path, ct, body, opts)
+}
+
+// Put sends a PUT for path to addr with body in content format ct.
+func (s *Server) Put(ctx context.Context, addr string, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodePut, path, ct, body, opts)
+}
+
+// Delete sends a DELETE for path to addr.
+func (s *Server) Delete(ctx context.Context, addr string, path string, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodeDelete, path, None, nil, opts)
+}
+
+// Fetch sends a FETCH (RFC 8132) for path to addr with the query body in
+// content format ct.
+func (s *Server) Fetch(ctx context.Context, addr string, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodeFetch, path, ct, body, opts)
+}
+
+// Patch sends a PATCH (RFC 8132) for path to addr with body in content
+// format ct.
+func (s *Server) Patch(ctx context.Context, addr string, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodePatch, path, ct, body, opts)
+}
+
+// IPatch sends an idempotent iPATCH (RFC 8132) for path to addr with body in
+// content format ct.
+func (s *Server) IPatch(ctx context.Context, addr string, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return s.request(ctx, addr, CodeIPatch, path, ct, body, opts)
+}
+
+func (s *Server) request(ctx context.Context, addr string, code COAPCode, path string, ct MediaType, body []byte, opts []RequestOption) (*Message, error) {
+	rc := &requestConfig{msg: NewMessage().WithType(TypeConfirmable).WithCode(code).WithPathString(path)}
+	if ct != None {
+		rc.msg.WithContentFormat(ct)
+	}
+	rc.msg.Payload = body
+	for _, opt := range opts {
+		opt(rc)
+	}
+	rsp, err := s.SendContext(ctx, addr, rc.msg, rc.options)
+	if err != nil || rsp == nil {
+		// non-confirmable requests do not wait for a response
+		return nil, err
+	}
+	return rsp, ResponseToError(rsp)
+}
+
+// Get sends a GET for path to the endpoint, see Server.Get.
+func (c *Client) Get(ctx context.Context, path string, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodeGet, path, None, nil, opts)
+}
+
+// Post sends a POST for path to the endpoint, see Server.Post.
+func (c *Client) Post(ctx context.Context, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodePost, path, ct, body, opts)
+}
+
+// Put sends a PUT for path to the endpoint, see Server.Put.
+func (c *Client) Put(ctx context.Context, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodePut, path, ct, body, opts)
+}
+
+// Delete sends a DELETE for path to the endpoint, see Server.Delete.
+func (c *Client) Delete(ctx context.Context, path string, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodeDelete, path, None, nil, opts)
+}
+
+// Fetch sends a FETCH for path to the endpoint, see Server.Fetch.
+func (c *Client) Fetch(ctx context.Context, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodeFetch, path, ct, body, opts)
+}
+
+// Patch sends a PATCH for path to the endpoint, see Server.Patch.
+func (c *Client) Patch(ctx context.Context, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodePatch, path, ct, body, opts)
+}
+
+// IPatch sends an iPATCH for path to the endpoint, see Server.IPatch.
+func (c *Client) IPatch(ctx context.Context, path string, ct MediaType, body []byte, opts ...RequestOption) (*Message, error) {
+	return c.request(ctx, CodeIPatch, path, ct, body, opts)
+}
+
+func (c *Client) request(ctx context.Context, code COAPCode, path string, ct MediaType, body []byte, opts []RequestOption) (*Message, error) {
+	// the default options of the Client apply unless a RequestOption
+	// replaces them
+	opts = append([]RequestOption{WithRequestSendOptions(c.Options())}, opts...)
+	return c.server.request(ctx, c.addr, code, path, ct, body, opts)
+}
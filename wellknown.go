@@ -0,0 +1,116 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package coap
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/qwerty-iot/coap/linkformat"
+)
+
+// WellKnownCorePath is the resource discovery path (RFC 6690 section 4).
+const WellKnownCorePath = "/.well-known/core"
+
+// LinkAttributes describe a route in the /.well-known/core listing.
+type LinkAttributes struct {
+	ResourceType  []string
+	Interface     []string
+	ContentFormat []MediaType
+	Size          int
+	Observable    bool
+	Title         string
+	// Extra holds any further target attributes, an empty value is written as
+	// a flag.
+	Extra map[string]string
+}
+
+// WithLink sets the attributes the route is listed with in /.well-known/core.
+func WithLink(attrs LinkAttributes) RouteOption {
+	return func(route *routeEntry) {
+		route.link = &attrs
+	}
+}
+
+// wellKnownCore answers GET /.well-known/core with the registered routes in
+// link-format, filtered by the request query (RFC 6690 section 4.1).
+func (s *Server) wellKnownCore(req *Message) *Message {
+	var lf linkformat.LinkFormat
+	for _, route := range s.listRoutes() {
+		lf = append(lf, route.linkValue())
+	}
+	if q := req.Options(OptURIQuery); len(q) > 0 {
+		lf = lf.FilterQuery(q[0].(string))
+		if len(lf) == 0 {
+			return req.MakeReply(RspCodeNotFound, nil)
+		}
+	}
+
+	rsp := req.MakeReply(RspCodeContent, nil).WithLinkFormat(lf)
+	if rsp.Meta.BlockSize == 0 {
+		rsp.Meta.BlockSize = s.config.BlockDefaultSize
+	}
+	return rsp
+}
+
+// listRoutes returns the routes that can be discovered, sorted by path.
+func (s *Server) listRoutes() []*routeEntry {
+	var routes []*routeEntry
+	for _, route := range s.walkRoutes() {
+		if route.discoverable() {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (r *routeEntry) discoverable() bool {
+	return len(r.path) != 0 && !strings.ContainsAny(r.path, "{~") && r.path != WellKnownCorePath
+}
+
+// linkValue returns the route as a link with its target attributes.
+func (r *routeEntry) linkValue() linkformat.Link {
+	l := linkformat.NewLink(r.path)
+	if r.link == nil {
+		return *l
+	}
+	a := r.link
+	if len(a.ResourceType) != 0 {
+		l.AddQuoted("rt", strings.Join(a.ResourceType, " "))
+	}
+	if len(a.Interface) != 0 {
+		l.AddQuoted("if", strings.Join(a.Interface, " "))
+	}
+	if len(a.ContentFormat) != 0 {
+		var cts []string
+		for _, ct := range a.ContentFormat {
+			cts = append(cts, strconv.Itoa(int(ct)))
+		}
+		l.Add("ct", strings.Join(cts, " "))
+	}
+	if a.Size > 0 {
+		l.Add("sz", strconv.Itoa(a.Size))
+	}
+	if a.Observable {
+		l.AddFlag("obs")
+	}
+	if len(a.Title) != 0 {
+		l.AddQuoted("title", a.Title)
+	}
+	var extra []string
+	for k := range a.Extra {
+		extra = append(extra, k)
+	}
+	sort.Strings(extra)
+	for _, k := range extra {
+		if len(a.Extra[k]) == 0 {
+			l.AddFlag(k)
+		} else {
+			l.Add(k, a.Extra[k])
+		}
+	}
+	return *l
+}